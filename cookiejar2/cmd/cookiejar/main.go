@@ -0,0 +1,372 @@
+// Command cookiejar inspects and edits stored cookiejar2 jars.
+//
+// A jar is given as a file path, "-" for stdin, or a RedisCookieStore as
+// redis://[:password@]host:port[,host:port...]/db[?master=name]#prefix.
+// Several hosts select a Redis Cluster, and master a Sentinel deployment,
+// in which case the hosts are the sentinels. Commands that modify a jar write
+// it back to where it was read from; stdin is written to stdout.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rmdashrf/go-misc/cookiejar2"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+// commands is filled in by init, as the commands refer to it for their usage.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"list":   {"list [-domain d] jar", list},
+		"show":   {"show jar domain;path;name", show},
+		"delete": {"delete [-n] [-site s] [-domain d] [-path p] [-name n] jar", del},
+		"purge":  {"purge [-n] [-session] jar", purge},
+		"merge":  {"merge [-resolve last|first|newest|longest] dst src...", merge},
+		"header": {"header jar url", header},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s command [arguments]\n\nCommands:\n", os.Args[0])
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nA jar is a file path, - for stdin, or\nredis://[:password@]host:port[,host:port...]/db[?master=name]#prefix.\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "cookiejar %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// flagSet returns a flag set for the named command that exits on errors.
+func flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s\n", os.Args[0], commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses args into fs, and exits with a usage message unless
+// exactly n positional arguments remain, or at least -n if n is negative.
+func parseArgs(fs *flag.FlagSet, args []string, n int) []string {
+	fs.Parse(args)
+	if (n >= 0 && fs.NArg() != n) || (n < 0 && fs.NArg() < -n) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return fs.Args()
+}
+
+func load(arg string) (source, cookiejar2.CookieEntries, error) {
+	src, err := openSource(arg)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries, err := src.load()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", src, err)
+	}
+	return src, entries, nil
+}
+
+// sortedKeys returns the eTLD+1 keys of entries, and the ids of each, in
+// sorted order.
+func sortedKeys(entries cookiejar2.CookieEntries) (keys []string, ids map[string][]string) {
+	ids = make(map[string][]string, len(entries))
+	for key, submap := range entries {
+		keys = append(keys, key)
+		for id := range submap {
+			ids[key] = append(ids[key], id)
+		}
+		sort.Strings(ids[key])
+	}
+	sort.Strings(keys)
+	return
+}
+
+func expiry(e cookiejar2.Entry) string {
+	if !e.Persistent {
+		return "session"
+	}
+	return e.Expires.Format(time.RFC3339)
+}
+
+func list(args []string) error {
+	fs := flagSet("list")
+	domain := fs.String("domain", "", "only list cookies whose domain is or is under `d`")
+	args = parseArgs(fs, args, 1)
+
+	_, entries, err := load(args[0])
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	keys, ids := sortedKeys(entries)
+	for _, key := range keys {
+		var matched []string
+		for _, id := range ids[key] {
+			if *domain == "" || domainMatches(entries[key][id].Domain, *domain) {
+				matched = append(matched, id)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(tw, "%s (%d)\n", key, len(matched))
+		for _, id := range matched {
+			e := entries[key][id]
+			fmt.Fprintf(tw, "  %s\t%q\t%s\n", id, e.Value, expiry(e))
+		}
+	}
+	return tw.Flush()
+}
+
+// sameSite returns the name of a SameSite mode. Cookies that did not specify
+// one get the default mode.
+func sameSite(mode http.SameSite) string {
+	switch mode {
+	case 0, http.SameSiteDefaultMode:
+		return "Default"
+	case http.SameSiteLaxMode:
+		return "Lax"
+	case http.SameSiteStrictMode:
+		return "Strict"
+	case http.SameSiteNoneMode:
+		return "None"
+	}
+	return fmt.Sprint(int(mode))
+}
+
+func show(args []string) error {
+	fs := flagSet("show")
+	args = parseArgs(fs, args, 2)
+
+	_, entries, err := load(args[0])
+	if err != nil {
+		return err
+	}
+
+	id := args[1]
+	for key, submap := range entries {
+		e, ok := submap[id]
+		if !ok {
+			continue
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "Key:\t%s\n", key)
+		fmt.Fprintf(tw, "Name:\t%s\n", e.Name)
+		fmt.Fprintf(tw, "Value:\t%q\n", e.Value)
+		fmt.Fprintf(tw, "Domain:\t%s\n", e.Domain)
+		fmt.Fprintf(tw, "Path:\t%s\n", e.Path)
+		fmt.Fprintf(tw, "HostOnly:\t%v\n", e.HostOnly)
+		fmt.Fprintf(tw, "Secure:\t%v\n", e.Secure)
+		fmt.Fprintf(tw, "HttpOnly:\t%v\n", e.HttpOnly)
+		fmt.Fprintf(tw, "SameSite:\t%s\n", sameSite(e.SameSite))
+		fmt.Fprintf(tw, "Expires:\t%s\n", expiry(e))
+		fmt.Fprintf(tw, "Creation:\t%s\n", e.Creation.Format(time.RFC3339))
+		fmt.Fprintf(tw, "LastAccess:\t%s\n", e.LastAccess.Format(time.RFC3339))
+		fmt.Fprintf(tw, "SeqNum:\t%d\n", e.SeqNum)
+		return tw.Flush()
+	}
+
+	return fmt.Errorf("no cookie %q", id)
+}
+
+// domainMatches reports whether domain is d or a subdomain of it.
+func domainMatches(domain, d string) bool {
+	d = strings.TrimPrefix(strings.ToLower(d), ".")
+	return domain == d || strings.HasSuffix(domain, "."+d)
+}
+
+// remove deletes the entries for which drop returns true, reports them on
+// stdout and saves the result unless dryRun is set.
+func remove(src source, entries cookiejar2.CookieEntries, dryRun bool, drop func(key string, e cookiejar2.Entry) bool) error {
+	// When the jar is written to stdout, report on stderr instead.
+	report := os.Stdout
+	if _, ok := src.(stdioSource); ok {
+		report = os.Stderr
+	}
+
+	removed := 0
+	keys, ids := sortedKeys(entries)
+	for _, key := range keys {
+		for _, id := range ids[key] {
+			if !drop(key, entries[key][id]) {
+				continue
+			}
+			fmt.Fprintf(report, "- %s\n", id)
+			delete(entries[key], id)
+			removed++
+		}
+		if len(entries[key]) == 0 {
+			delete(entries, key)
+		}
+	}
+	fmt.Fprintf(report, "%d cookies removed\n", removed)
+
+	if dryRun || removed == 0 {
+		return nil
+	}
+	if err := src.save(entries); err != nil {
+		return fmt.Errorf("%s: %v", src, err)
+	}
+	return nil
+}
+
+func del(args []string) error {
+	fs := flagSet("delete")
+	dryRun := fs.Bool("n", false, "only report what would be deleted")
+	site := fs.String("site", "", "delete cookies stored under the eTLD+1 `s`")
+	domain := fs.String("domain", "", "delete cookies whose domain is or is under `d`")
+	path := fs.String("path", "", "delete cookies with path `p`")
+	name := fs.String("name", "", "delete cookies named `n`")
+	args = parseArgs(fs, args, 1)
+
+	if *site == "" && *domain == "" && *path == "" && *name == "" {
+		return errors.New("refusing to delete every cookie; give at least one of -site, -domain, -path or -name")
+	}
+
+	src, entries, err := load(args[0])
+	if err != nil {
+		return err
+	}
+
+	return remove(src, entries, *dryRun, func(key string, e cookiejar2.Entry) bool {
+		if *site != "" && key != strings.ToLower(*site) {
+			return false
+		}
+		if *domain != "" && !domainMatches(e.Domain, *domain) {
+			return false
+		}
+		if *path != "" && e.Path != *path {
+			return false
+		}
+		if *name != "" && e.Name != *name {
+			return false
+		}
+		return true
+	})
+}
+
+func purge(args []string) error {
+	fs := flagSet("purge")
+	dryRun := fs.Bool("n", false, "only report what would be purged")
+	session := fs.Bool("session", false, "also purge session cookies")
+	args = parseArgs(fs, args, 1)
+
+	src, entries, err := load(args[0])
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return remove(src, entries, *dryRun, func(key string, e cookiejar2.Entry) bool {
+		if !e.Persistent {
+			return *session
+		}
+		return !e.Expires.After(now)
+	})
+}
+
+var resolvers = map[string]cookiejar2.ConflictResolver{
+	"last":    cookiejar2.PreferLast,
+	"first":   cookiejar2.PreferFirst,
+	"newest":  cookiejar2.PreferNewest,
+	"longest": cookiejar2.PreferLongestLived,
+}
+
+func merge(args []string) error {
+	fs := flagSet("merge")
+	resolveName := fs.String("resolve", "last", "which cookie to keep when it is in several jars: last, first, newest or longest")
+	args = parseArgs(fs, args, -2)
+
+	resolve, ok := resolvers[*resolveName]
+	if !ok {
+		return fmt.Errorf("unknown resolver %q", *resolveName)
+	}
+
+	dst, merged, err := load(args[0])
+	if err != nil {
+		return err
+	}
+
+	all := []cookiejar2.CookieEntries{merged}
+	for _, arg := range args[1:] {
+		_, entries, err := load(arg)
+		if err != nil {
+			return err
+		}
+		all = append(all, entries)
+	}
+
+	if err := dst.save(cookiejar2.MergeEntries(resolve, all...)); err != nil {
+		return fmt.Errorf("%s: %v", dst, err)
+	}
+	return nil
+}
+
+func header(args []string) error {
+	fs := flagSet("header")
+	args = parseArgs(fs, args, 2)
+
+	_, entries, err := load(args[0])
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(args[1])
+	if err != nil {
+		return err
+	}
+
+	jar := cookiejar2.New(nil)
+	jar.SetEntries(entries)
+
+	req := &http.Request{Header: make(http.Header)}
+	for _, c := range jar.Cookies(u) {
+		req.AddCookie(c)
+	}
+	fmt.Println(req.Header.Get("Cookie"))
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/rmdashrf/go-misc/cookiejar2"
+	"github.com/rmdashrf/go-misc/rediscookiestore"
+)
+
+// writerID is published as the invalidation token when saving a blob store to
+// Redis. It never matches the id of a RedisCookieStore, so every jar using the
+// store reloads.
+const writerID = "cookiejar-cli"
+
+// source is a place jar entries are loaded from and saved to.
+type source interface {
+	load() (cookiejar2.CookieEntries, error)
+	save(entries cookiejar2.CookieEntries) error
+	String() string
+}
+
+// openSource parses a source argument: "-" for stdin and stdout, a
+// redis://[:password@]host:port[,host:port...]/db[?master=name]#prefix URL
+// for a RedisCookieStore, and a file path otherwise.
+func openSource(arg string) (source, error) {
+	if arg == "-" {
+		return stdioSource{}, nil
+	}
+	if strings.HasPrefix(arg, "redis://") {
+		return openRedis(arg)
+	}
+	return fileSource(arg), nil
+}
+
+func encode(entries cookiejar2.CookieEntries) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := cookiejar2.NewEncoder(&buf)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(entries); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type stdioSource struct{}
+
+func (stdioSource) load() (cookiejar2.CookieEntries, error) {
+	contents, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	return cookiejar2.UnmarshalEntries(contents)
+}
+
+func (stdioSource) save(entries cookiejar2.CookieEntries) error {
+	contents, err := encode(entries)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(contents)
+	return err
+}
+
+func (stdioSource) String() string {
+	return "stdin"
+}
+
+type fileSource string
+
+func (f fileSource) load() (cookiejar2.CookieEntries, error) {
+	contents, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return nil, err
+	}
+	return cookiejar2.UnmarshalEntries(contents)
+}
+
+// save replaces the file through a rename, so that it is never left half
+// written. The file keeps its mode; new files are only accessible to their
+// owner, as they hold credentials.
+func (f fileSource) save(entries cookiejar2.CookieEntries) error {
+	contents, err := encode(entries)
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0600)
+	if fi, err := os.Stat(string(f)); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(string(f)), filepath.Base(string(f))+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), string(f))
+}
+
+func (f fileSource) String() string {
+	return string(f)
+}
+
+type redisSource struct {
+	client redis.UniversalClient
+	prefix string
+
+	// url is the URL of the store, without its password.
+	url string
+}
+
+func openRedis(arg string) (*redisSource, error) {
+	i := strings.LastIndex(arg, "#")
+	if i == -1 || i == len(arg)-1 {
+		return nil, fmt.Errorf("%s: missing #prefix of the store", rediscookiestore.RedactURL(arg))
+	}
+
+	opts, err := rediscookiestore.ParseURL(arg[:i])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", rediscookiestore.RedactURL(arg), err)
+	}
+
+	return &redisSource{
+		client: redis.NewUniversalClient(opts),
+		prefix: arg[i+1:],
+		url:    rediscookiestore.RedactURL(arg),
+	}, nil
+}
+
+// load reads the entries of the store, which may have been saved by either
+// a RedisCookieStore or a HashCookieStore.
+func (r *redisSource) load() (cookiejar2.CookieEntries, error) {
+	hash, err := rediscookiestore.IsHashStore(r.client, r.prefix)
+	if err != nil {
+		return nil, err
+	}
+	if hash {
+		store := rediscookiestore.NewHashCookieStore(r.client, r.prefix)
+		defer store.Close()
+		return store.Load()
+	}
+
+	contents, err := r.client.Get(rediscookiestore.StoreName(r.prefix)).Bytes()
+	if err == redis.Nil {
+		return make(cookiejar2.CookieEntries), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return cookiejar2.UnmarshalEntries(contents)
+}
+
+// save stores entries and publishes an invalidation, so that jars using the
+// store pick up the change. Stores saved by a HashCookieStore are saved
+// through one, after loading them so that the cookies missing from entries
+// are deleted.
+func (r *redisSource) save(entries cookiejar2.CookieEntries) error {
+	hash, err := rediscookiestore.IsHashStore(r.client, r.prefix)
+	if err != nil {
+		return err
+	}
+	if hash {
+		store := rediscookiestore.NewHashCookieStore(r.client, r.prefix)
+		defer store.Close()
+		if _, err := store.Load(); err != nil {
+			return err
+		}
+		return store.Save(entries)
+	}
+
+	return rediscookiestore.SetCookies(r.client, r.prefix, entries, writerID)
+}
+
+func (r *redisSource) String() string {
+	return r.url
+}
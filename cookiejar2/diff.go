@@ -0,0 +1,321 @@
+package cookiejar2
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ChangeKind is the kind of a Change between two sets of entries.
+type ChangeKind int
+
+const (
+	// Added means the cookie only exists in the new entries.
+	Added ChangeKind = iota + 1
+
+	// Removed means the cookie only exists in the old entries.
+	Removed
+
+	// ValueChanged means the value of the cookie differs. Its attributes may
+	// have changed as well.
+	ValueChanged
+
+	// AttributesChanged means only the attributes of the cookie differ.
+	AttributesChanged
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case ValueChanged:
+		return "value changed"
+	case AttributesChanged:
+		return "attributes changed"
+	}
+	return fmt.Sprintf("ChangeKind(%d)", int(k))
+}
+
+// Change describes how a single cookie differs between two sets of entries.
+type Change struct {
+	Kind ChangeKind
+
+	// Key is the eTLD+1 and ID the domain;path;name triple under which the
+	// cookie is stored.
+	Key string
+	ID  string
+
+	// Old and New are the entry in the old and in the new entries. Old is
+	// the zero Entry for Added, and New is the zero Entry for Removed.
+	Old Entry
+	New Entry
+
+	// Attributes are the names of the Entry fields that differ, other than
+	// Value. The bookkeeping fields Creation, LastAccess and SeqNum are not
+	// compared.
+	Attributes []string
+}
+
+// Diff is a list of changes, sorted by Key and ID.
+type Diff []Change
+
+// DiffEntries computes the changes that turn old into new.
+func DiffEntries(old, new CookieEntries) Diff {
+	var d Diff
+
+	for key, submap := range old {
+		for id, o := range submap {
+			n, ok := new[key][id]
+			if !ok {
+				d = append(d, Change{Kind: Removed, Key: key, ID: id, Old: o})
+				continue
+			}
+
+			attrs := changedAttributes(o, n)
+			switch {
+			case o.Value != n.Value:
+				d = append(d, Change{Kind: ValueChanged, Key: key, ID: id, Old: o, New: n, Attributes: attrs})
+			case len(attrs) > 0:
+				d = append(d, Change{Kind: AttributesChanged, Key: key, ID: id, Old: o, New: n, Attributes: attrs})
+			}
+		}
+	}
+
+	for key, submap := range new {
+		for id, n := range submap {
+			if _, ok := old[key][id]; !ok {
+				d = append(d, Change{Kind: Added, Key: key, ID: id, New: n})
+			}
+		}
+	}
+
+	sort.Slice(d, func(i, j int) bool {
+		if d[i].Key != d[j].Key {
+			return d[i].Key < d[j].Key
+		}
+		return d[i].ID < d[j].ID
+	})
+	return d
+}
+
+// changedAttributes returns the names of the attributes that differ between
+// a and b.
+func changedAttributes(a, b Entry) (attrs []string) {
+	if a.Domain != b.Domain {
+		attrs = append(attrs, "Domain")
+	}
+	if a.Path != b.Path {
+		attrs = append(attrs, "Path")
+	}
+	if a.Secure != b.Secure {
+		attrs = append(attrs, "Secure")
+	}
+	if a.HttpOnly != b.HttpOnly {
+		attrs = append(attrs, "HttpOnly")
+	}
+	if a.Persistent != b.Persistent {
+		attrs = append(attrs, "Persistent")
+	}
+	if a.HostOnly != b.HostOnly {
+		attrs = append(attrs, "HostOnly")
+	}
+	if a.SameSite != b.SameSite {
+		attrs = append(attrs, "SameSite")
+	}
+	if !a.Expires.Equal(b.Expires) {
+		attrs = append(attrs, "Expires")
+	}
+	return
+}
+
+// attributeValue formats the named attribute of e for display.
+func attributeValue(e Entry, name string) string {
+	switch name {
+	case "Domain":
+		return e.Domain
+	case "Path":
+		return e.Path
+	case "Secure":
+		return fmt.Sprint(e.Secure)
+	case "HttpOnly":
+		return fmt.Sprint(e.HttpOnly)
+	case "Persistent":
+		return fmt.Sprint(e.Persistent)
+	case "HostOnly":
+		return fmt.Sprint(e.HostOnly)
+	case "SameSite":
+		switch e.SameSite {
+		case 0:
+			return "unset"
+		case http.SameSiteDefaultMode:
+			return "default"
+		case http.SameSiteLaxMode:
+			return "lax"
+		case http.SameSiteStrictMode:
+			return "strict"
+		case http.SameSiteNoneMode:
+			return "none"
+		}
+		return fmt.Sprint(int(e.SameSite))
+	case "Expires":
+		if !e.Persistent {
+			return "session"
+		}
+		return e.Expires.UTC().Format(time.RFC3339)
+	}
+	return ""
+}
+
+// Format writes a human readable rendering of d to w, grouped by eTLD+1:
+//
+//	example.com
+//	  + example.com;/;session = "abc"
+//	  - example.com;/;tracking = "1"
+//	  ~ example.com;/;lang = "en" -> "de"
+//	  ~ example.com;/;pref Secure: false -> true
+func (d Diff) Format(w io.Writer) error {
+	key := ""
+	for i, c := range d {
+		if i == 0 || c.Key != key {
+			key = c.Key
+			if _, err := fmt.Fprintln(w, key); err != nil {
+				return err
+			}
+		}
+
+		var line string
+		switch c.Kind {
+		case Added:
+			line = fmt.Sprintf("+ %s = %q", c.ID, c.New.Value)
+		case Removed:
+			line = fmt.Sprintf("- %s = %q", c.ID, c.Old.Value)
+		default:
+			var parts []string
+			if c.Kind == ValueChanged {
+				parts = append(parts, fmt.Sprintf("= %q -> %q", c.Old.Value, c.New.Value))
+			}
+			for _, attr := range c.Attributes {
+				parts = append(parts, fmt.Sprintf("%s: %s -> %s", attr, attributeValue(c.Old, attr), attributeValue(c.New, attr)))
+			}
+			line = fmt.Sprintf("~ %s %s", c.ID, strings.Join(parts, ", "))
+		}
+
+		if _, err := fmt.Fprintf(w, "  %s\n", line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d Diff) String() string {
+	var buf bytes.Buffer
+	d.Format(&buf)
+	return buf.String()
+}
+
+// ConflictResolver chooses the entry to keep when the same cookie appears in
+// more than one of the sets of entries being merged. a is the entry merged so
+// far, and b the entry from a later set.
+type ConflictResolver func(a, b Entry) Entry
+
+// PreferFirst keeps the entry from the earliest set.
+func PreferFirst(a, b Entry) Entry {
+	return a
+}
+
+// PreferLast keeps the entry from the latest set.
+func PreferLast(a, b Entry) Entry {
+	return b
+}
+
+// PreferNewest keeps the entry with the later LastAccess, which is updated
+// whenever a cookie is set or sent. Ties go to the later set.
+func PreferNewest(a, b Entry) Entry {
+	if a.LastAccess.After(b.LastAccess) {
+		return a
+	}
+	return b
+}
+
+// PreferLongestLived keeps the entry that expires last, counting session
+// cookies as never expiring. Ties go to the later set.
+func PreferLongestLived(a, b Entry) Entry {
+	if a.Expires.After(b.Expires) {
+		return a
+	}
+	return b
+}
+
+// MergeEntries merges the given sets of entries into a new set, calling
+// resolve for every cookie that appears in more than one of them. A nil
+// resolve is equivalent to PreferLast. The arguments are not modified.
+//
+// The sets may come from different jars, whose sequence numbers collide, so
+// the merged entries are renumbered from 1 in the order of their creation
+// time and then of their sequence number.
+func MergeEntries(resolve ConflictResolver, entries ...CookieEntries) CookieEntries {
+	if resolve == nil {
+		resolve = PreferLast
+	}
+
+	ret := make(CookieEntries)
+	for _, set := range entries {
+		for key, submap := range set {
+			merged := ret[key]
+			if merged == nil {
+				merged = make(map[string]Entry, len(submap))
+				ret[key] = merged
+			}
+
+			for id, e := range submap {
+				if existing, ok := merged[id]; ok {
+					e = resolve(existing, e)
+				}
+				merged[id] = e
+			}
+		}
+	}
+
+	renumber(ret)
+	return ret
+}
+
+// renumber assigns new sequence numbers to entries, in the order in which
+// Cookies returns cookies with the same path. Ties are broken by key and id,
+// so that the numbering is deterministic.
+func renumber(entries CookieEntries) {
+	type ref struct {
+		key, id string
+		e       Entry
+	}
+	var refs []ref
+	for key, submap := range entries {
+		for id, e := range submap {
+			refs = append(refs, ref{key, id, e})
+		}
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		a, b := refs[i], refs[j]
+		switch {
+		case !a.e.Creation.Equal(b.e.Creation):
+			return a.e.Creation.Before(b.e.Creation)
+		case a.e.SeqNum != b.e.SeqNum:
+			return a.e.SeqNum < b.e.SeqNum
+		case a.key != b.key:
+			return a.key < b.key
+		}
+		return a.id < b.id
+	})
+
+	for i, r := range refs {
+		r.e.SeqNum = uint64(i + 1)
+		entries[r.key][r.id] = r.e
+	}
+}
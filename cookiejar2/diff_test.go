@@ -0,0 +1,96 @@
+package cookiejar2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiffEntries(t *testing.T) {
+	before := testEntries()
+	after := testEntries()
+
+	a := after["example.com"]["example.com;/;a"]
+	a.Value = "2"
+	a.LastAccess = a.LastAccess.Add(time.Hour)
+	after["example.com"]["example.com;/;a"] = a
+	after["other.org"] = map[string]Entry{
+		"other.org;/;b": {Name: "b", Value: "x", Domain: "other.org", Path: "/", Secure: true},
+	}
+
+	d := DiffEntries(before, after)
+	if len(d) != 2 {
+		t.Fatalf("expected 2 changes, got %v", d)
+	}
+	if d[0].Kind != ValueChanged || len(d[0].Attributes) != 0 {
+		t.Errorf("expected a value change without attributes, got %+v", d[0])
+	}
+	if d[1].Kind != Added || d[1].Key != "other.org" {
+		t.Errorf("expected other.org to be added, got %+v", d[1])
+	}
+
+	b := after["other.org"]["other.org;/;b"]
+	b.Secure = false
+	changed := CookieEntries{"other.org": {"other.org;/;b": b}}
+	d = DiffEntries(after, changed)
+	if len(d) != 2 || d[0].Kind != Removed || d[1].Kind != AttributesChanged || d[1].Attributes[0] != "Secure" {
+		t.Fatalf("unexpected diff: %+v", d)
+	}
+
+	want := "example.com\n  - example.com;/;a = \"2\"\nother.org\n  ~ other.org;/;b Secure: true -> false\n"
+	if got := d.String(); got != want {
+		t.Errorf("unexpected rendering:\n%s", got)
+	}
+	if DiffEntries(after, after) != nil {
+		t.Errorf("expected no changes")
+	}
+}
+
+func TestMergeEntries(t *testing.T) {
+	older := testEntries()
+	newer := testEntries()
+	e := newer["example.com"]["example.com;/;a"]
+	e.Value = "new"
+	e.LastAccess = e.LastAccess.Add(time.Minute)
+	newer["example.com"]["example.com;/;a"] = e
+
+	for _, tc := range []struct {
+		name    string
+		resolve ConflictResolver
+		sets    []CookieEntries
+		want    string
+	}{
+		{"first", PreferFirst, []CookieEntries{older, newer}, "1"},
+		{"last", PreferLast, []CookieEntries{older, newer}, "new"},
+		{"newest", PreferNewest, []CookieEntries{newer, older}, "new"},
+	} {
+		merged := MergeEntries(tc.resolve, tc.sets...)
+		if got := merged["example.com"]["example.com;/;a"].Value; got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.want, got)
+		}
+	}
+
+	if older["example.com"]["example.com;/;a"].Value != "1" || newer["example.com"]["example.com;/;a"].Value != "new" {
+		t.Errorf("merge modified its arguments")
+	}
+}
+
+func TestMergeEntriesRenumbers(t *testing.T) {
+	// Both jars numbered their only cookie 1.
+	first, second := testEntries(), testEntries()
+	e := second["example.com"]["example.com;/;a"]
+	e.Name = "b"
+	e.Creation = e.Creation.Add(-time.Minute)
+	delete(second["example.com"], "example.com;/;a")
+	second["example.com"]["example.com;/;b"] = e
+
+	for _, sets := range [][]CookieEntries{{first, second}, {second, first}} {
+		merged := MergeEntries(nil, sets...)
+		a, b := merged["example.com"]["example.com;/;a"], merged["example.com"]["example.com;/;b"]
+		if b.SeqNum != 1 || a.SeqNum != 2 {
+			t.Errorf("sequence numbers %d and %d, want the older cookie first", b.SeqNum, a.SeqNum)
+		}
+	}
+	if first["example.com"]["example.com;/;a"].SeqNum != 1 {
+		t.Errorf("merge modified its arguments")
+	}
+}
@@ -0,0 +1,202 @@
+package cookiejar2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// SchemaVersion is the version of the serialization format written by
+// MarshalEntries and Encoder.
+//
+// Version 1 is the original format: the CookieEntries map encoded as is with
+// encoding/json, without a version marker. Version 2 wraps the map in an
+// envelope of the form {"version": 2, "entries": {...}}.
+//
+// Fields added to Entry with a usable zero value do not require a new
+// version. The version must be bumped whenever a change would cause older
+// readers to misinterpret the data, so that they fail instead.
+const SchemaVersion = 2
+
+// ErrUnsupportedVersion is returned when decoding entries that were written
+// with a newer schema than this package understands.
+var ErrUnsupportedVersion = errors.New("cookiejar: unsupported entries schema version")
+
+type envelope struct {
+	Version int           `json:"version"`
+	Entries CookieEntries `json:"entries"`
+}
+
+// entryDecoders decode the serialized form of each schema version, migrating
+// it to the current CookieEntries.
+var entryDecoders = map[int]func(data []byte) (CookieEntries, error){
+	1: decodeEntriesV1,
+	2: decodeEntriesV2,
+}
+
+func decodeEntriesV1(data []byte) (entries CookieEntries, err error) {
+	err = json.Unmarshal(data, &entries)
+	return
+}
+
+func decodeEntriesV2(data []byte) (CookieEntries, error) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	return env.Entries, nil
+}
+
+// MarshalEntries serializes entries in the current schema version.
+func MarshalEntries(entries CookieEntries) ([]byte, error) {
+	return json.Marshal(envelope{Version: SchemaVersion, Entries: entries})
+}
+
+// UnmarshalEntries deserializes entries written by MarshalEntries or an
+// Encoder, in the current or any earlier schema version, including the
+// unversioned JSON written by plain json.Marshal. A nil map is never
+// returned on success.
+func UnmarshalEntries(data []byte) (CookieEntries, error) {
+	version, err := schemaVersion(data)
+	if err != nil {
+		return nil, err
+	}
+
+	decode, ok := entryDecoders[version]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+
+	entries, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if entries == nil {
+		entries = make(CookieEntries)
+	}
+	return entries, nil
+}
+
+// schemaVersion determines the schema version of data. Unversioned data is
+// a map of eTLD+1 keys to objects, so a "version" key holding a number can
+// only be found in an envelope.
+func schemaVersion(data []byte) (int, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return 0, err
+	}
+
+	raw, ok := probe["version"]
+	if !ok || len(raw) == 0 || raw[0] == '{' {
+		return 1, nil
+	}
+
+	var version int
+	if err := json.Unmarshal(raw, &version); err != nil {
+		return 0, fmt.Errorf("cookiejar: malformed schema version: %v", err)
+	}
+	return version, nil
+}
+
+// stableEntry is Entry without the volatile fields Creation and LastAccess,
+// which change whenever a jar is regenerated or used. It must list the other
+// fields of Entry under the same names.
+type stableEntry struct {
+	Name       string
+	Value      string
+	Domain     string
+	Path       string
+	Secure     bool
+	HttpOnly   bool
+	Persistent bool
+	HostOnly   bool
+	SameSite   http.SameSite
+	Expires    time.Time
+	SeqNum     uint64
+}
+
+func stableEntries(entries CookieEntries) map[string]map[string]stableEntry {
+	ret := make(map[string]map[string]stableEntry, len(entries))
+	for key, submap := range entries {
+		stable := make(map[string]stableEntry, len(submap))
+		for id, e := range submap {
+			stable[id] = stableEntry{
+				Name:       e.Name,
+				Value:      e.Value,
+				Domain:     e.Domain,
+				Path:       e.Path,
+				Secure:     e.Secure,
+				HttpOnly:   e.HttpOnly,
+				Persistent: e.Persistent,
+				HostOnly:   e.HostOnly,
+				SameSite:   e.SameSite,
+				Expires:    e.Expires,
+				SeqNum:     e.SeqNum,
+			}
+		}
+		ret[key] = stable
+	}
+	return ret
+}
+
+// An Encoder writes CookieEntries in the current schema version to an output
+// stream. Keys are written in sorted order, so encoding the same entries
+// always produces the same output.
+type Encoder struct {
+	enc          *json.Encoder
+	omitVolatile bool
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{enc: json.NewEncoder(w)}
+}
+
+// SetIndent instructs the encoder to format each subsequent encoded value as
+// if indented by json.MarshalIndent.
+func (enc *Encoder) SetIndent(prefix, indent string) {
+	enc.enc.SetIndent(prefix, indent)
+}
+
+// SetOmitVolatile instructs the encoder to leave out the Creation and
+// LastAccess fields, which change every time a jar is regenerated or used.
+// This makes the output suitable for committing to version control. The
+// reduced form decodes with those fields zero.
+func (enc *Encoder) SetOmitVolatile(omit bool) {
+	enc.omitVolatile = omit
+}
+
+// Encode writes entries to the stream, followed by a newline character.
+func (enc *Encoder) Encode(entries CookieEntries) error {
+	if enc.omitVolatile {
+		return enc.enc.Encode(struct {
+			Version int                               `json:"version"`
+			Entries map[string]map[string]stableEntry `json:"entries"`
+		}{SchemaVersion, stableEntries(entries)})
+	}
+	return enc.enc.Encode(envelope{Version: SchemaVersion, Entries: entries})
+}
+
+// A Decoder reads CookieEntries in any supported schema version from an
+// input stream.
+type Decoder struct {
+	dec *json.Decoder
+}
+
+// NewDecoder returns a new decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{dec: json.NewDecoder(r)}
+}
+
+// Decode reads the next set of entries from the stream.
+func (dec *Decoder) Decode() (CookieEntries, error) {
+	var raw json.RawMessage
+	if err := dec.dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	return UnmarshalEntries(raw)
+}
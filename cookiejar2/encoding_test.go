@@ -0,0 +1,141 @@
+package cookiejar2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testEntries() CookieEntries {
+	creation := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	return CookieEntries{
+		"example.com": {
+			"example.com;/;a": {
+				Name:       "a",
+				Value:      "1",
+				Domain:     "example.com",
+				Path:       "/",
+				HostOnly:   true,
+				Expires:    endOfTime,
+				Creation:   creation,
+				LastAccess: creation,
+				SeqNum:     1,
+			},
+		},
+	}
+}
+
+func TestUnmarshalLegacyEntries(t *testing.T) {
+	legacy, err := json.Marshal(testEntries())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := UnmarshalEntries(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := entries["example.com"]["example.com;/;a"]; !ok || e.Value != "1" {
+		t.Fatalf("legacy entry not decoded: %v", entries)
+	}
+}
+
+func TestEntriesRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(testEntries()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(buf.Bytes(), []byte(`{"version":2,`)) {
+		t.Fatalf("missing version envelope: %s", buf.String())
+	}
+
+	entries, err := NewDecoder(&buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := entries["example.com"]["example.com;/;a"]; e.SeqNum != 1 || !e.Creation.Equal(testEntries()["example.com"]["example.com;/;a"].Creation) {
+		t.Fatalf("entry did not survive round trip: %+v", e)
+	}
+}
+
+func TestEncodeOmitVolatile(t *testing.T) {
+	encode := func(entries CookieEntries) string {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.SetOmitVolatile(true)
+		if err := enc.Encode(entries); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	entries := testEntries()
+	first := encode(entries)
+	if bytes.Contains([]byte(first), []byte("LastAccess")) || bytes.Contains([]byte(first), []byte("Creation")) {
+		t.Fatalf("volatile fields not omitted: %s", first)
+	}
+
+	e := entries["example.com"]["example.com;/;a"]
+	e.LastAccess = e.LastAccess.Add(time.Hour)
+	e.Creation = e.Creation.Add(time.Hour)
+	entries["example.com"]["example.com;/;a"] = e
+	entries["example.org"] = map[string]Entry{}
+	entries["example.net"] = map[string]Entry{}
+	if second := encode(entries); second != encode(CookieEntries{
+		"example.com": testEntries()["example.com"],
+		"example.net": {},
+		"example.org": {},
+	}) {
+		t.Fatalf("output depends on volatile fields: %s", second)
+	}
+
+	decoded, err := UnmarshalEntries([]byte(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testEntries()["example.com"]["example.com;/;a"]
+	want.Creation, want.LastAccess = time.Time{}, time.Time{}
+	if got := decoded["example.com"]["example.com;/;a"]; got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
+
+// TestStableEntryFields ensures stableEntry keeps up with new Entry fields.
+func TestStableEntryFields(t *testing.T) {
+	entry := reflect.TypeOf(Entry{})
+	stable := reflect.TypeOf(stableEntry{})
+	for i := 0; i < entry.NumField(); i++ {
+		f := entry.Field(i)
+		if f.Name == "Creation" || f.Name == "LastAccess" {
+			continue
+		}
+		if sf, ok := stable.FieldByName(f.Name); !ok || sf.Type != f.Type {
+			t.Errorf("stableEntry is missing field %s %s", f.Name, f.Type)
+		}
+	}
+}
+
+func TestUnmarshalEntriesEdgeCases(t *testing.T) {
+	// An eTLD+1 key that happens to be named "version" is legacy data.
+	entries, err := UnmarshalEntries([]byte(`{"version":{"version;/;a":{"Name":"a"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entries["version"]["version;/;a"]; !ok {
+		t.Fatalf("legacy entry keyed by \"version\" not decoded: %v", entries)
+	}
+
+	entries, err = UnmarshalEntries([]byte(`null`))
+	if err != nil || entries == nil {
+		t.Fatalf("expected empty entries, got %v, %v", entries, err)
+	}
+
+	_, err = UnmarshalEntries([]byte(`{"version":99,"entries":{}}`))
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+}
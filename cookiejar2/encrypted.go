@@ -0,0 +1,282 @@
+package cookiejar2
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// BlobStorage stores serialized cookie entries without interpreting them.
+// It can be wrapped by an EntryStorage that transforms the serialized form,
+// such as EncryptedStorage.
+type BlobStorage interface {
+	// SaveBlob saves data, with the same guarantees as EntryStorage.Save.
+	SaveBlob(data []byte) error
+
+	// LoadBlob returns the last saved data, or nil if nothing has been saved
+	// yet. Must be goroutine safe.
+	LoadBlob() ([]byte, error)
+
+	// InvalidationEvents is the same as EntryStorage.InvalidationEvents.
+	InvalidationEvents() <-chan struct{}
+}
+
+var (
+	// ErrUnknownKey is returned when loading entries that were encrypted
+	// with a key that is not in the keyring.
+	ErrUnknownKey = errors.New("cookiejar: entries encrypted with unknown key")
+
+	// ErrTampered is returned when loading entries that fail
+	// authentication, because they were modified or are truncated.
+	ErrTampered = errors.New("cookiejar: encrypted entries failed authentication")
+
+	// ErrNotEncrypted is returned when loading entries that are not
+	// encrypted, unless plaintext is explicitly allowed.
+	ErrNotEncrypted = errors.New("cookiejar: entries are not encrypted")
+
+	errNoPrimaryKey = errors.New("cookiejar: keyring has no primary key")
+)
+
+// encryptedMagic starts every blob written by EncryptedStorage. It is
+// followed by a format version byte, the length of the key ID as a byte, the
+// key ID, the nonce and the sealed entries. Everything before the nonce is
+// authenticated as additional data, followed by EncryptedOptions.Context,
+// which is not stored.
+var encryptedMagic = []byte("CJ2E")
+
+const encryptedFormat = 1
+
+// Keyring holds the AES keys used by an EncryptedStorage, by key ID. New
+// entries are encrypted with the primary key; entries encrypted with any key
+// in the ring can be loaded.
+//
+// To rotate keys without downtime, first add the new key to the keyring of
+// every process, then make it primary. Entries are re-encrypted with the new
+// key on their next save, after which the old key can be removed.
+type Keyring struct {
+	mu      sync.RWMutex
+	keys    map[string]cipher.AEAD
+	primary string
+}
+
+// NewKeyring returns an empty keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]cipher.AEAD)}
+}
+
+// Add adds a 16, 24 or 32 byte AES key under id. The first key added becomes
+// the primary key. IDs are at most 255 bytes long.
+func (k *Keyring) Add(id string, key []byte) error {
+	if len(id) == 0 || len(id) > 255 {
+		return fmt.Errorf("cookiejar: invalid key id %q", id)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys[id] = aead
+	if k.primary == "" {
+		k.primary = id
+	}
+	return nil
+}
+
+// SetPrimary makes the key with the given id the one used for encryption.
+func (k *Keyring) SetPrimary(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	k.primary = id
+	return nil
+}
+
+// Remove removes the key with the given id. Entries encrypted with it can no
+// longer be loaded.
+func (k *Keyring) Remove(id string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	delete(k.keys, id)
+	if k.primary == id {
+		k.primary = ""
+	}
+}
+
+func (k *Keyring) primaryKey() (string, cipher.AEAD, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.primary == "" {
+		return "", nil, errNoPrimaryKey
+	}
+	return k.primary, k.keys[k.primary], nil
+}
+
+func (k *Keyring) key(id string) (cipher.AEAD, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	aead, ok := k.keys[id]
+	return aead, ok
+}
+
+// EncryptedOptions are the options for creating a new EncryptedStorage.
+type EncryptedOptions struct {
+	// If AllowPlaintext is set, unencrypted entries are loaded instead of
+	// failing with ErrNotEncrypted. This allows migrating existing storage;
+	// the entries are encrypted on their next save.
+	AllowPlaintext bool
+
+	// Context is authenticated along with the entries without being stored.
+	// It should identify the store, such as by its key, so that entries
+	// copied from the store of another account fail to load with
+	// ErrTampered. Entries saved with a different Context, including those
+	// saved before it was set, cannot be loaded.
+	Context []byte
+}
+
+// EncryptedStorage is an EntryStorage that encrypts the serialized entries
+// with AES-GCM before handing them to a BlobStorage.
+type EncryptedStorage struct {
+	blobs          BlobStorage
+	keys           *Keyring
+	allowPlaintext bool
+	context        []byte
+}
+
+// NewEncryptedStorage returns a new EncryptedStorage that stores its entries
+// in blobs, encrypted with keys. A nil *EncryptedOptions is equivalent to a
+// zero EncryptedOptions.
+func NewEncryptedStorage(blobs BlobStorage, keys *Keyring, o *EncryptedOptions) *EncryptedStorage {
+	if o == nil {
+		o = &EncryptedOptions{}
+	}
+
+	return &EncryptedStorage{
+		blobs:          blobs,
+		keys:           keys,
+		allowPlaintext: o.AllowPlaintext,
+		context:        append([]byte{}, o.Context...),
+	}
+}
+
+// additionalData returns the data authenticated along with entries stored
+// with the given header.
+func (s *EncryptedStorage) additionalData(header []byte) []byte {
+	ad := make([]byte, 0, len(header)+len(s.context))
+	ad = append(ad, header...)
+	return append(ad, s.context...)
+}
+
+// Save encrypts entries with the primary key and saves them.
+func (s *EncryptedStorage) Save(entries CookieEntries) error {
+	plaintext, err := MarshalEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	id, aead, err := s.keys.primaryKey()
+	if err != nil {
+		return err
+	}
+
+	header := append([]byte{}, encryptedMagic...)
+	header = append(header, encryptedFormat, byte(len(id)))
+	header = append(header, id...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	blob := make([]byte, 0, len(header)+len(nonce)+len(plaintext)+aead.Overhead())
+	blob = append(blob, header...)
+	blob = append(blob, nonce...)
+	blob = aead.Seal(blob, nonce, plaintext, s.additionalData(header))
+	return s.blobs.SaveBlob(blob)
+}
+
+// Load loads and decrypts the entries. Entries that were modified after they
+// were encrypted fail with ErrTampered.
+func (s *EncryptedStorage) Load() (CookieEntries, error) {
+	blob, err := s.blobs.LoadBlob()
+	if err != nil {
+		return nil, err
+	}
+	if blob == nil {
+		return make(CookieEntries), nil
+	}
+
+	if !bytes.HasPrefix(blob, encryptedMagic) {
+		if !s.allowPlaintext {
+			return nil, ErrNotEncrypted
+		}
+		return UnmarshalEntries(blob)
+	}
+
+	plaintext, err := s.decrypt(blob)
+	if err != nil {
+		return nil, err
+	}
+	return UnmarshalEntries(plaintext)
+}
+
+func (s *EncryptedStorage) decrypt(blob []byte) ([]byte, error) {
+	rest := blob[len(encryptedMagic):]
+	if len(rest) < 2 {
+		return nil, ErrTampered
+	}
+	if rest[0] != encryptedFormat {
+		return nil, fmt.Errorf("cookiejar: unsupported encryption format %d", rest[0])
+	}
+
+	idLen := int(rest[1])
+	rest = rest[2:]
+	if len(rest) < idLen {
+		return nil, ErrTampered
+	}
+	id := string(rest[:idLen])
+	rest = rest[idLen:]
+
+	aead, ok := s.keys.key(id)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrTampered
+	}
+	header := blob[:len(blob)-len(rest)]
+	nonce, ciphertext := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, s.additionalData(header))
+	if err != nil {
+		return nil, ErrTampered
+	}
+	return plaintext, nil
+}
+
+// InvalidationEvents returns the invalidation events of the underlying
+// BlobStorage.
+func (s *EncryptedStorage) InvalidationEvents() <-chan struct{} {
+	return s.blobs.InvalidationEvents()
+}
+
+var _ EntryStorage = (*EncryptedStorage)(nil)
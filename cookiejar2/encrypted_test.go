@@ -0,0 +1,124 @@
+package cookiejar2
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+type memoryBlobs struct {
+	data []byte
+}
+
+func (m *memoryBlobs) SaveBlob(data []byte) error {
+	m.data = append([]byte{}, data...)
+	return nil
+}
+
+func (m *memoryBlobs) LoadBlob() ([]byte, error) {
+	return m.data, nil
+}
+
+func (m *memoryBlobs) InvalidationEvents() <-chan struct{} {
+	return nil
+}
+
+func TestEncryptedStorageRotation(t *testing.T) {
+	keys := NewKeyring()
+	if err := keys.Add("k1", bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := &memoryBlobs{}
+	s := NewEncryptedStorage(blobs, keys, nil)
+	if err := s.Save(testEntries()); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(blobs.data, []byte("example.com")) {
+		t.Fatal("entries were stored in plaintext")
+	}
+
+	// Rotate: entries encrypted with the old key stay readable, and the
+	// next save uses the new one.
+	keys.Add("k2", bytes.Repeat([]byte{2}, 32))
+	keys.SetPrimary("k2")
+	entries, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	keys.Remove("k1")
+	entries, err = s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries["example.com"]["example.com;/;a"].Value != "1" {
+		t.Fatalf("unexpected entries after rotation: %v", entries)
+	}
+
+	keys.Remove("k2")
+	if _, err := s.Load(); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestEncryptedStorageTampering(t *testing.T) {
+	keys := NewKeyring()
+	keys.Add("k1", bytes.Repeat([]byte{1}, 16))
+
+	blobs := &memoryBlobs{}
+	s := NewEncryptedStorage(blobs, keys, nil)
+	s.Save(testEntries())
+
+	blobs.data[len(blobs.data)-1] ^= 1
+	if _, err := s.Load(); err != ErrTampered {
+		t.Fatalf("expected ErrTampered, got %v", err)
+	}
+
+	blobs.data = blobs.data[:10]
+	if _, err := s.Load(); err != ErrTampered {
+		t.Fatalf("expected ErrTampered for truncated data, got %v", err)
+	}
+}
+
+func TestEncryptedStorageContext(t *testing.T) {
+	keys := NewKeyring()
+	keys.Add("k1", bytes.Repeat([]byte{1}, 16))
+
+	alice := &memoryBlobs{}
+	bob := &memoryBlobs{}
+	a := NewEncryptedStorage(alice, keys, &EncryptedOptions{Context: []byte("accounts:alice")})
+	b := NewEncryptedStorage(bob, keys, &EncryptedOptions{Context: []byte("accounts:bob")})
+	if err := a.Save(testEntries()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries swapped into the store of another account do not load.
+	bob.data = append([]byte{}, alice.data...)
+	if _, err := b.Load(); err != ErrTampered {
+		t.Fatalf("expected ErrTampered for entries of another store, got %v", err)
+	}
+}
+
+func TestEncryptedStoragePlaintext(t *testing.T) {
+	keys := NewKeyring()
+	keys.Add("k1", bytes.Repeat([]byte{1}, 16))
+
+	plaintext, _ := MarshalEntries(testEntries())
+	blobs := &memoryBlobs{data: plaintext}
+
+	if _, err := NewEncryptedStorage(blobs, keys, nil).Load(); err != ErrNotEncrypted {
+		t.Fatalf("expected ErrNotEncrypted, got %v", err)
+	}
+
+	entries, err := NewEncryptedStorage(blobs, keys, &EncryptedOptions{AllowPlaintext: true}).Load()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected plaintext entries to load, got %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,96 @@
+package cookiejar2
+
+import (
+	"fmt"
+	"time"
+)
+
+// Storage operations reported in a StorageError.
+const (
+	OpLoad = "load"
+	OpSave = "save"
+)
+
+// StorageError is reported for errors returned by the EntryStorage of a Jar.
+type StorageError struct {
+	// Op is the operation that failed, either OpLoad or OpSave.
+	Op  string
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("cookiejar: storage %s: %v", e.Op, e.Err)
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// Health reports the state of the storage of a Jar.
+type Health struct {
+	// LastLoad and LastSave are the times of the last successful load and
+	// save. They are zero if there was none.
+	LastLoad time.Time
+	LastSave time.Time
+
+	// LastError is the last storage error, and LastErrorTime the time it
+	// occurred. LastError is kept after later operations succeed.
+	LastError     error
+	LastErrorTime time.Time
+
+	// loadErr and saveErr are the errors of the most recent load and save,
+	// nil if they succeeded.
+	loadErr error
+	saveErr error
+}
+
+// Err returns an error if the most recent load or the most recent save
+// failed, and nil otherwise. It is suitable for readiness checks.
+func (h Health) Err() error {
+	if h.saveErr != nil {
+		return h.saveErr
+	}
+	return h.loadErr
+}
+
+// Health returns the state of the storage of the jar.
+func (j *Jar) Health() Health {
+	j.healthMu.Lock()
+	defer j.healthMu.Unlock()
+	return j.health
+}
+
+// reportSuccess records a successful storage operation.
+func (j *Jar) reportSuccess(op string) {
+	now := time.Now()
+
+	j.healthMu.Lock()
+	switch op {
+	case OpLoad:
+		j.health.LastLoad = now
+		j.health.loadErr = nil
+	case OpSave:
+		j.health.LastSave = now
+		j.health.saveErr = nil
+	}
+	j.healthMu.Unlock()
+}
+
+// reportError records a failed storage operation and fires the error
+// callback.
+func (j *Jar) reportError(err *StorageError) {
+	j.healthMu.Lock()
+	j.health.LastError = err
+	j.health.LastErrorTime = time.Now()
+	switch err.Op {
+	case OpLoad:
+		j.health.loadErr = err
+	case OpSave:
+		j.health.saveErr = err
+	}
+	j.healthMu.Unlock()
+
+	if j.errorCallback != nil {
+		j.errorCallback(err)
+	}
+}
@@ -0,0 +1,133 @@
+package cookiejar2
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errFlaky = errors.New("storage unavailable")
+
+// flakyStorage fails the given number of loads and saves before it succeeds.
+type flakyStorage struct {
+	mu           sync.Mutex
+	failLoads    int
+	failSaves    int
+	saveAttempts int
+	loadAttempts int
+}
+
+func (f *flakyStorage) Save(entries CookieEntries) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.saveAttempts++
+	if f.failSaves > 0 {
+		f.failSaves--
+		return errFlaky
+	}
+	return nil
+}
+
+func (f *flakyStorage) Load() (CookieEntries, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.loadAttempts++
+	if f.failLoads > 0 {
+		f.failLoads--
+		return nil, errFlaky
+	}
+	return make(CookieEntries), nil
+}
+
+func (f *flakyStorage) InvalidationEvents() <-chan struct{} {
+	return nil
+}
+
+func quietLogger() *log.Logger {
+	return log.New(ioutil.Discard, "", 0)
+}
+
+func TestLoadReturnsStorageError(t *testing.T) {
+	_, err := Load(&Options{
+		Storage:             &flakyStorage{failLoads: 1},
+		IgnoreInvalidations: true,
+	})
+
+	var serr *StorageError
+	if !errors.As(err, &serr) || serr.Op != OpLoad || !errors.Is(err, errFlaky) {
+		t.Fatalf("expected load StorageError, got %v", err)
+	}
+}
+
+func TestSaveRetriesAndHealth(t *testing.T) {
+	storage := &flakyStorage{failSaves: 3}
+	var reported []error
+	jar := New(&Options{
+		Storage:             storage,
+		IgnoreInvalidations: true,
+		ErrorLog:            quietLogger(),
+		SaveRetries:         1,
+		SaveRetryBackoff:    time.Millisecond,
+		ErrorCallback: func(err error) {
+			reported = append(reported, err)
+		},
+	})
+
+	if err := jar.Health().Err(); err != nil || jar.Health().LastLoad.IsZero() {
+		t.Fatalf("expected healthy jar after load, got %+v", jar.Health())
+	}
+
+	u, _ := url.Parse("http://example.com/")
+	jar.SetCookies(u, []*http.Cookie{{Name: "a", Value: "1"}})
+	jar.SaveCookies()
+
+	if storage.saveAttempts != 2 || len(reported) != 1 {
+		t.Fatalf("expected 2 attempts and 1 report, got %d and %d", storage.saveAttempts, len(reported))
+	}
+	if err := jar.Health().Err(); !errors.Is(err, errFlaky) {
+		t.Fatalf("expected unhealthy jar, got %v", err)
+	}
+
+	// The third failure is retried, and the jar recovers.
+	jar.SaveCookies()
+	h := jar.Health()
+	if h.Err() != nil || h.LastSave.IsZero() || h.LastError == nil {
+		t.Fatalf("expected recovered jar with last error kept, got %+v", h)
+	}
+}
+
+func TestSaveOnSetCookiesRetriesInBackground(t *testing.T) {
+	storage := &flakyStorage{failSaves: 2}
+	jar := New(&Options{
+		Storage:             storage,
+		SaveOnSetCookies:    true,
+		IgnoreInvalidations: true,
+		ErrorLog:            quietLogger(),
+		SaveRetries:         3,
+		SaveRetryBackoff:    50 * time.Millisecond,
+	})
+
+	u, _ := url.Parse("http://example.com/")
+	start := time.Now()
+	jar.SetCookies(u, []*http.Cookie{{Name: "a", Value: "1"}})
+	jar.SetCookies(u, []*http.Cookie{{Name: "b", Value: "1"}})
+	if d := time.Since(start); d >= 50*time.Millisecond {
+		t.Fatalf("SetCookies waited %v for retries", d)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for jar.Health().LastSave.IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatalf("retries did not save: %+v", jar.Health())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := jar.Health().Err(); err != nil {
+		t.Fatalf("expected healthy jar after retries, got %v", err)
+	}
+}
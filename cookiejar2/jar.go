@@ -18,6 +18,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/publicsuffix"
@@ -57,6 +58,7 @@ type EntryStorage interface {
 	// Saves the cookie entries to the backing storage. A non-nil error will
 	// be logged, but otherwise ignored. It is up to the implementor to ensure
 	// that Save() will not trigger an invalidation event on the same EntryStorage.
+	// The entries may be shared with the jar and must not be modified.
 	// Must be goroutine safe.
 	Save(entries CookieEntries) error
 
@@ -98,41 +100,166 @@ type Options struct {
 	// If non-nil, error logging will be directed to this logger. Otherwise,
 	// messages will go to os.Stderr
 	ErrorLog *log.Logger
+
+	// If non-nil, ErrorCallback is called with a *StorageError whenever a
+	// load or save fails. A save is only reported once all of its retries
+	// have failed.
+	ErrorCallback func(error)
+
+	// SaveRetries is the number of times a failed save is retried before it
+	// is given up. Saves made by SaveOnSetCookies are retried in the
+	// background, and SaveCookies waits for its retries.
+	SaveRetries int
+
+	// SaveRetryBackoff is the delay before the first retry of a failed save.
+	// It doubles with every further retry. Defaults to 100ms.
+	SaveRetryBackoff time.Duration
+
+	// If MaxLifetime is positive, persistent cookies expire at most
+	// MaxLifetime after they are set, regardless of their Max-Age and
+	// Expires attributes. ChromiumMaxLifetime matches current browsers.
+	// Entries loaded from Storage expire at most MaxLifetime after they are
+	// loaded.
+	MaxLifetime time.Duration
+
+	// If NewSession is set, session (non-persistent) cookies are dropped
+	// from the initial load from Storage, as when a browser is restarted.
+	// They are removed from Storage on the next save, and until then also
+	// dropped from reloads caused by invalidation events. Session cookies
+	// saved to Storage since the initial load are kept, since they belong to
+	// the current session.
+	NewSession bool
 }
 
+// ChromiumMaxLifetime is the maximum cookie lifetime enforced by Chromium,
+// 400 days, for use as Options.MaxLifetime.
+const ChromiumMaxLifetime = 400 * 24 * time.Hour
+
 // Jar implements the http.CookieJar interface from the net/http package.
+//
+// Entries are split into shards by their eTLD+1, so that requests to
+// different sites do not contend for the same lock. Cookies() only takes a
+// read lock unless it finds expired entries to remove, and records LastAccess
+// updates aside until the next write or save. Saving to storage happens
+// outside of the shard locks.
 type Jar struct {
+	// nextSeqNum is the next sequence number assigned to a new cookie
+	// created SetCookies. Accessed atomically, and kept first for 64-bit
+	// alignment.
+	nextSeqNum uint64
+
+	// modCount is incremented on every modification of the entries.
+	// Accessed atomically.
+	modCount uint64
+
 	psList PublicSuffixList
 
 	logger              *log.Logger
+	errorCallback       func(error)
 	storage             EntryStorage
 	saveOnSetCookies    bool
 	ignoreInvalidations bool
-
-	// mu locks the remaining fields.
-	mu sync.Mutex
-
-	// entries is a set of entries, keyed by their eTLD+1 and subkeyed by
-	// their name/domain/path.
-	entries CookieEntries
-
-	// nextSeqNum is the next sequence number assigned to a new cookie
-	// created SetCookies.
-	nextSeqNum uint64
+	saveRetries         int
+	saveRetryBackoff    time.Duration
+	maxLifetime         time.Duration
+	newSession          bool
+
+	shards [numShards]shard
+
+	// saveMu serializes saves, so that snapshots reach the storage in the
+	// order they were taken. It locks savedCount.
+	saveMu sync.Mutex
+
+	// savedCount is the modCount of the last snapshot successfully saved.
+	savedCount uint64
+
+	// loadMu serializes loads, so that the entries of a load never replace
+	// those of a later one, such as a reload for an invalidation received
+	// during the initial load.
+	loadMu sync.Mutex
+
+	// retryMu locks retrying and retryAgain. retrying is set while failed
+	// saves made by SetCookies are retried in the background, and
+	// retryAgain when another one failed in the meantime.
+	retryMu    sync.Mutex
+	retrying   bool
+	retryAgain bool
+
+	// sessionMu locks previousSession, the session entries dropped from the
+	// initial load under NewSession. They are dropped from reloads as well,
+	// until a save removed them from storage.
+	sessionMu       sync.Mutex
+	previousSession CookieEntries
+
+	// healthMu locks health.
+	healthMu sync.Mutex
+	health   Health
 }
 
 // New returns a new cookie jar. A nil *Options is equivalent to a zero
 // Options.
 func New(o *Options) *Jar {
+	jar := newJar(o)
+
+	if jar.storage != nil && !jar.ignoreInvalidations {
+		go jar.listenForInvalidations(nil)
+	}
+
+	if jar.storage != nil {
+		if err := jar.loadFromStorage(true); err != nil {
+			jar.logger.Printf("Failed to load initial set of cookies from storage: %v\n", err)
+		}
+	}
+
+	return jar
+}
+
+// Load is like New, but returns an error instead of an empty jar if the
+// initial set of cookies cannot be loaded from o.Storage. The error is a
+// *StorageError.
+func Load(o *Options) (*Jar, error) {
+	jar := newJar(o)
+
+	if jar.storage != nil {
+		// The jar listens before loading, so that the invalidations sent
+		// during the load are not missed; they reload once it completes.
+		var stop chan struct{}
+		if !jar.ignoreInvalidations {
+			stop = make(chan struct{})
+			go jar.listenForInvalidations(stop)
+		}
+
+		if err := jar.loadFromStorage(true); err != nil {
+			if stop != nil {
+				close(stop)
+			}
+			return nil, &StorageError{Op: OpLoad, Err: err}
+		}
+	}
+
+	return jar, nil
+}
+
+// newJar returns a new jar without loading from storage.
+func newJar(o *Options) *Jar {
 	if o == nil {
 		o = &Options{}
 	}
 
 	jar := &Jar{
-		entries:             make(map[string]map[string]Entry),
 		storage:             o.Storage,
 		saveOnSetCookies:    o.SaveOnSetCookies,
 		ignoreInvalidations: o.IgnoreInvalidations,
+		errorCallback:       o.ErrorCallback,
+		saveRetries:         o.SaveRetries,
+		saveRetryBackoff:    o.SaveRetryBackoff,
+		maxLifetime:         o.MaxLifetime,
+		newSession:          o.NewSession,
+		nextSeqNum:          1,
+	}
+
+	if jar.saveRetryBackoff <= 0 {
+		jar.saveRetryBackoff = 100 * time.Millisecond
 	}
 
 	var suffixList PublicSuffixList
@@ -150,16 +277,6 @@ func New(o *Options) *Jar {
 		jar.logger = o.ErrorLog
 	}
 
-	if jar.storage != nil && !jar.ignoreInvalidations {
-		go jar.listenForInvalidations()
-	}
-
-	if jar.storage != nil {
-		if err := jar.loadFromStorage(); err != nil {
-			log.Printf("Failed to load initial set of cookies from storage: %v\n", err)
-		}
-	}
-
 	return jar
 }
 
@@ -176,14 +293,17 @@ type Entry struct {
 	HttpOnly   bool
 	Persistent bool
 	HostOnly   bool
+	SameSite   http.SameSite
 	Expires    time.Time
 	Creation   time.Time
 	LastAccess time.Time
 
-	// seqNum is a sequence number so that Cookies returns cookies in a
+	// SeqNum is a sequence number so that Cookies returns cookies in a
 	// deterministic order, even for cookies that have equal Path length and
-	// equal Creation time. This simplifies testing.
-	seqNum uint64
+	// equal Creation time. It is exported so that the order survives a round
+	// trip through storage. Sequence numbers start at 1; entries saved before
+	// SeqNum was persisted have a SeqNum of 0 and are renumbered on load.
+	SeqNum uint64
 }
 
 // id returns the domain;path;name triple of e as an id.
@@ -236,18 +356,38 @@ func (j *Jar) Cookies(u *url.URL) (cookies []*http.Cookie) {
 // Creates a deep copy of the entries in the cookiejar, suitable for
 // serialization purposes
 func (j *Jar) Entries() CookieEntries {
-	j.mu.Lock()
+	return j.collect((*shard).copyEntries)
+}
 
+// snapshot is like Entries, but shares the submaps with the jar. The result
+// must not be modified. Pending LastAccess updates are applied to the shards
+// first, so that later snapshots do not have to copy the same submaps again.
+func (j *Jar) snapshot() CookieEntries {
+	for i := range j.shards {
+		s := &j.shards[i]
+		if s.hasAccess() {
+			s.mu.Lock()
+			s.applyAccess()
+			s.mu.Unlock()
+		}
+	}
+	return j.collect((*shard).snapshotEntries)
+}
+
+func (j *Jar) collect(add func(s *shard, dst CookieEntries)) CookieEntries {
 	ret := make(map[string]map[string]Entry)
 
-	for k1, v1 := range j.entries {
-		ck1 := make(map[string]Entry)
-		for k2, v2 := range v1 {
-			ck1[k2] = v2
-		}
-		ret[k1] = ck1
+	// Hold every shard at once, so that the result is consistent with a
+	// concurrent SetEntries or reload.
+	for i := range j.shards {
+		j.shards[i].mu.RLock()
+	}
+	for i := range j.shards {
+		add(&j.shards[i], ret)
+	}
+	for i := range j.shards {
+		j.shards[i].mu.RUnlock()
 	}
-	j.mu.Unlock()
 
 	return ret
 }
@@ -255,9 +395,83 @@ func (j *Jar) Entries() CookieEntries {
 // Sets the entries of the cookiejar to the supplied entries. Callers should
 // not use the supplied map after this call.
 func (j *Jar) SetEntries(new map[string]map[string]Entry) {
-	j.mu.Lock()
-	j.entries = new
-	j.mu.Unlock()
+	j.restoreSeqNums(new)
+
+	var split [numShards]CookieEntries
+	for key, submap := range new {
+		i := shardIndex(key)
+		if split[i] == nil {
+			split[i] = make(CookieEntries)
+		}
+		split[i][key] = submap
+	}
+
+	for i := range j.shards {
+		j.shards[i].mu.Lock()
+	}
+	for i := range j.shards {
+		s := &j.shards[i]
+		s.entries = split[i]
+		s.accessMu.Lock()
+		s.accessed = nil
+		s.accessMu.Unlock()
+	}
+	atomic.AddUint64(&j.modCount, 1)
+	for i := range j.shards {
+		j.shards[i].mu.Unlock()
+	}
+}
+
+// restoreSeqNums numbers entries that have no sequence number yet, and makes
+// sure that nextSeqNum does not collide with any of the given entries.
+func (j *Jar) restoreSeqNums(entries CookieEntries) {
+	type unnumbered struct {
+		key, id string
+		e       Entry
+	}
+
+	var (
+		missing []unnumbered
+		max     uint64
+	)
+	for key, submap := range entries {
+		for id, e := range submap {
+			if e.SeqNum == 0 {
+				missing = append(missing, unnumbered{key, id, e})
+			} else if e.SeqNum > max {
+				max = e.SeqNum
+			}
+		}
+	}
+
+	for {
+		next := atomic.LoadUint64(&j.nextSeqNum)
+		if max < next || atomic.CompareAndSwapUint64(&j.nextSeqNum, next, max+1) {
+			break
+		}
+	}
+
+	// Number legacy entries in creation order, falling back to the id so
+	// that every jar loading the same entries agrees on the order.
+	sort.Slice(missing, func(a, b int) bool {
+		m := missing
+		if !m[a].e.Creation.Equal(m[b].e.Creation) {
+			return m[a].e.Creation.Before(m[b].e.Creation)
+		}
+		if m[a].key != m[b].key {
+			return m[a].key < m[b].key
+		}
+		return m[a].id < m[b].id
+	})
+	for _, u := range missing {
+		u.e.SeqNum = j.newSeqNum()
+		entries[u.key][u.id] = u.e
+	}
+}
+
+// newSeqNum allocates the next sequence number.
+func (j *Jar) newSeqNum() uint64 {
+	return atomic.AddUint64(&j.nextSeqNum, 1) - 1
 }
 
 // cookies is like Cookies but takes the current time as a parameter.
@@ -271,42 +485,42 @@ func (j *Jar) cookies(u *url.URL, now time.Time) (cookies []*http.Cookie) {
 	}
 	key := jarKey(host, j.psList)
 
-	j.mu.Lock()
-	defer j.mu.Unlock()
-
-	submap := j.entries[key]
-	if submap == nil {
-		return cookies
-	}
-
 	https := u.Scheme == "https"
 	path := u.Path
 	if path == "" {
 		path = "/"
 	}
 
-	modified := false
-	var selected []Entry
-	for id, e := range submap {
+	s := &j.shards[shardIndex(key)]
+	s.mu.RLock()
+
+	var (
+		selected []Entry
+		ids      []string
+		expired  bool
+	)
+	for id, e := range s.entries[key] {
 		if e.Persistent && !e.Expires.After(now) {
-			delete(submap, id)
-			modified = true
+			expired = true
 			continue
 		}
 		if !e.shouldSend(https, host, path) {
 			continue
 		}
-		e.LastAccess = now
-		submap[id] = e
+		ids = append(ids, id)
 		selected = append(selected, e)
-		modified = true
 	}
-	if modified {
-		if len(submap) == 0 {
-			delete(j.entries, key)
-		} else {
-			j.entries[key] = submap
+	s.mu.RUnlock()
+
+	if len(ids) > 0 {
+		s.recordAccess(key, ids, now)
+	}
+	if expired {
+		s.mu.Lock()
+		if s.removeExpired(key, now) {
+			atomic.AddUint64(&j.modCount, 1)
 		}
+		s.mu.Unlock()
 	}
 
 	// sort according to RFC 6265 section 5.4 point 2: by longest
@@ -319,7 +533,7 @@ func (j *Jar) cookies(u *url.URL, now time.Time) (cookies []*http.Cookie) {
 		if !s[i].Creation.Equal(s[j].Creation) {
 			return s[i].Creation.Before(s[j].Creation)
 		}
-		return s[i].seqNum < s[j].seqNum
+		return s[i].SeqNum < s[j].SeqNum
 	})
 	for _, e := range selected {
 		cookies = append(cookies, &http.Cookie{Name: e.Name, Value: e.Value})
@@ -350,12 +564,25 @@ func (j *Jar) setCookies(u *url.URL, cookies []*http.Cookie, now time.Time) {
 	key := jarKey(host, j.psList)
 	defPath := defaultPath(u.Path)
 
-	j.mu.Lock()
-	defer j.mu.Unlock()
-
-	submap := j.entries[key]
+	s := &j.shards[shardIndex(key)]
+	s.mu.Lock()
 
+	// The submap may be shared with a snapshot, so modify a copy. Pending
+	// LastAccess updates are applied along the way.
+	times := s.takeAccess(key)
+	submap := make(map[string]Entry, len(s.entries[key])+len(cookies))
 	modified := false
+	for id, e := range s.entries[key] {
+		if e.Persistent && !e.Expires.After(now) {
+			modified = true
+			continue
+		}
+		if t, ok := times[id]; ok && t.After(e.LastAccess) {
+			e.LastAccess = t
+		}
+		submap[id] = e
+	}
+
 	for _, cookie := range cookies {
 		e, remove, err := j.newEntry(cookie, now, defPath, host)
 		if err != nil {
@@ -363,51 +590,147 @@ func (j *Jar) setCookies(u *url.URL, cookies []*http.Cookie, now time.Time) {
 		}
 		id := e.id()
 		if remove {
-			if submap != nil {
-				if _, ok := submap[id]; ok {
-					delete(submap, id)
-					modified = true
-				}
+			if _, ok := submap[id]; ok {
+				delete(submap, id)
+				modified = true
 			}
 			continue
 		}
-		if submap == nil {
-			submap = make(map[string]Entry)
-		}
 
 		if old, ok := submap[id]; ok {
 			e.Creation = old.Creation
-			e.seqNum = old.seqNum
+			e.SeqNum = old.SeqNum
 		} else {
 			e.Creation = now
-			e.seqNum = j.nextSeqNum
-			j.nextSeqNum++
+			e.SeqNum = j.newSeqNum()
 		}
 		e.LastAccess = now
 		submap[id] = e
 		modified = true
 	}
 
-	if modified {
+	if modified || len(times) > 0 {
 		if len(submap) == 0 {
-			delete(j.entries, key)
+			delete(s.entries, key)
 		} else {
-			j.entries[key] = submap
+			if s.entries == nil {
+				s.entries = make(CookieEntries)
+			}
+			s.entries[key] = submap
+		}
+	}
+	if modified {
+		atomic.AddUint64(&j.modCount, 1)
+	}
+	s.mu.Unlock()
+
+	if modified && j.storage != nil && j.saveOnSetCookies {
+		j.saveCookies(false)
+	}
+}
+
+// saveCookies saves a snapshot of the entries to storage, retrying with
+// backoff on failure. Unless force is set, the save is skipped if an earlier
+// save already covered every modification made before the call, and its
+// retries happen in the background, so that SetCookies does not wait for
+// them. No shard lock may be held.
+func (j *Jar) saveCookies(force bool) {
+	err := j.save(force)
+	if err == nil {
+		return
+	}
+
+	if j.saveRetries == 0 {
+		j.saveFailed(err)
+		return
+	}
+	if force {
+		if err := j.retrySave(true); err != nil {
+			j.saveFailed(err)
 		}
+		return
+	}
+
+	j.retryMu.Lock()
+	defer j.retryMu.Unlock()
+	if j.retrying {
+		// The running retries save the latest entries, but must go on if
+		// they just succeeded before this failure.
+		j.retryAgain = true
+		return
+	}
+	j.retrying = true
+	go j.retryInBackground()
+}
+
+// save saves a snapshot of the entries, unless force is not set and an
+// earlier save already covered every modification made before the call.
+func (j *Jar) save(force bool) error {
+	count := atomic.LoadUint64(&j.modCount)
+
+	j.saveMu.Lock()
+	defer j.saveMu.Unlock()
+
+	if !force && j.savedCount >= count {
+		return nil
+	}
+
+	count = atomic.LoadUint64(&j.modCount)
+	if err := j.storage.Save(j.snapshot()); err != nil {
+		return err
+	}
+	j.savedCount = count
+	j.reportSuccess(OpSave)
+
+	// The session entries of the previous session are gone from storage.
+	j.sessionMu.Lock()
+	j.previousSession = nil
+	j.sessionMu.Unlock()
+	return nil
+}
 
-		if j.storage != nil && j.saveOnSetCookies {
-			j.saveCookies()
+// retrySave retries a failed save with backoff, and returns the error of the
+// last attempt. saveMu is not held while waiting, so that other saves can
+// proceed, and retries are skipped once they covered every modification
+// unless force is set.
+func (j *Jar) retrySave(force bool) (err error) {
+	backoff := j.saveRetryBackoff
+	for attempt := 0; attempt < j.saveRetries; attempt++ {
+		time.Sleep(backoff)
+		backoff *= 2
+
+		if err = j.save(force); err == nil {
+			return nil
 		}
 	}
+	return err
 }
 
-// Lock should already be acquired
-func (j *Jar) saveCookies() {
-	if err := j.storage.Save(j.entries); err != nil {
-		j.logger.Printf("Failed to save cookies: %v\n", err)
+// retryInBackground retries failed saves until they succeed or are given up,
+// including the saves that failed while it was retrying.
+func (j *Jar) retryInBackground() {
+	for {
+		if err := j.retrySave(false); err != nil {
+			j.saveFailed(err)
+		}
+
+		j.retryMu.Lock()
+		if !j.retryAgain {
+			j.retrying = false
+			j.retryMu.Unlock()
+			return
+		}
+		j.retryAgain = false
+		j.retryMu.Unlock()
 	}
 }
 
+// saveFailed reports a save that was given up.
+func (j *Jar) saveFailed(err error) {
+	j.logger.Printf("Failed to save cookies: %v\n", err)
+	j.reportError(&StorageError{Op: OpSave, Err: err})
+}
+
 // canonicalHost strips port from host if present and returns the canonicalized
 // host name.
 func canonicalHost(host string) (string, error) {
@@ -528,9 +851,16 @@ func (j *Jar) newEntry(c *http.Cookie, now time.Time, defPath, host string) (e E
 		}
 	}
 
+	if e.Persistent && j.maxLifetime > 0 {
+		if limit := now.Add(j.maxLifetime); e.Expires.After(limit) {
+			e.Expires = limit
+		}
+	}
+
 	e.Value = c.Value
 	e.Secure = c.Secure
 	e.HttpOnly = c.HttpOnly
+	e.SameSite = c.SameSite
 
 	return e, false, nil
 }
@@ -606,30 +936,108 @@ func (j *Jar) domainAndType(host, domain string) (string, bool, error) {
 	return domain, false, nil
 }
 
-func (j *Jar) loadFromStorage() error {
+// loadFromStorage replaces the entries of the jar with those in storage.
+// initial is set for the load when the jar is created.
+func (j *Jar) loadFromStorage(initial bool) error {
 	if j.storage == nil {
 		panic("loadFromStorage called with no storage")
 	}
 
+	j.loadMu.Lock()
+	defer j.loadMu.Unlock()
+
 	newEntries, err := j.storage.Load()
 	if err != nil {
+		j.reportError(&StorageError{Op: OpLoad, Err: err})
 		return err
 	}
+	// The storage may keep the map it returned, and SetEntries takes
+	// ownership of the map it is given.
+	newEntries = cloneEntries(newEntries)
+
+	j.clampLifetimes(newEntries, time.Now())
 
-	j.mu.Lock()
-	defer j.mu.Unlock()
-	j.entries = newEntries
+	j.sessionMu.Lock()
+	if initial && j.newSession {
+		j.previousSession = dropSessionEntries(newEntries)
+	} else if j.previousSession != nil {
+		dropEntries(newEntries, j.previousSession)
+	}
+	j.sessionMu.Unlock()
 
+	j.SetEntries(newEntries)
+	j.reportSuccess(OpLoad)
 	return nil
 }
 
-func (j *Jar) listenForInvalidations() {
+// clampLifetimes makes the persistent entries expire at most MaxLifetime
+// after now.
+func (j *Jar) clampLifetimes(entries CookieEntries, now time.Time) {
+	if j.maxLifetime <= 0 {
+		return
+	}
+
+	limit := now.Add(j.maxLifetime)
+	for _, submap := range entries {
+		for id, e := range submap {
+			if e.Persistent && e.Expires.After(limit) {
+				e.Expires = limit
+				submap[id] = e
+			}
+		}
+	}
+}
+
+// dropSessionEntries removes the non-persistent entries from entries, and
+// returns them.
+func dropSessionEntries(entries CookieEntries) CookieEntries {
+	dropped := make(CookieEntries)
+	for key, submap := range entries {
+		for id, e := range submap {
+			if e.Persistent {
+				continue
+			}
+			if dropped[key] == nil {
+				dropped[key] = make(map[string]Entry)
+			}
+			dropped[key][id] = e
+			delete(submap, id)
+		}
+		if len(submap) == 0 {
+			delete(entries, key)
+		}
+	}
+	return dropped
+}
+
+// dropEntries removes the entries in drop from entries, unless they were
+// created again since.
+func dropEntries(entries, drop CookieEntries) {
+	for key, submap := range drop {
+		for id, e := range submap {
+			if cur, ok := entries[key][id]; ok && cur.Creation.Equal(e.Creation) {
+				delete(entries[key], id)
+			}
+		}
+		if len(entries[key]) == 0 {
+			delete(entries, key)
+		}
+	}
+}
+
+// listenForInvalidations reloads the jar on every invalidation event of its
+// storage, until stop is closed.
+func (j *Jar) listenForInvalidations(stop <-chan struct{}) {
 	invalidationCh := j.storage.InvalidationEvents()
 	for {
-		<-invalidationCh
+		select {
+		case <-invalidationCh:
+		case <-stop:
+			return
+		}
 		j.logger.Println("Reloading in memory cookie entries due to invalidation event")
 
-		if err := j.loadFromStorage(); err != nil {
+		if err := j.loadFromStorage(false); err != nil {
 			j.logger.Printf("Failed to reload from storage: %v\n", err)
 		}
 	}
@@ -640,8 +1048,5 @@ func (j *Jar) SaveCookies() {
 		return
 	}
 
-	j.mu.Lock()
-	defer j.mu.Unlock()
-
-	j.saveCookies()
+	j.saveCookies(true)
 }
@@ -0,0 +1,397 @@
+package cookiejar2
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func cookieNames(cookies []*http.Cookie) (names []string) {
+	for _, c := range cookies {
+		names = append(names, c.Name)
+	}
+	return
+}
+
+func TestSeqNumSurvivesRoundTrip(t *testing.T) {
+	u, _ := url.Parse("https://www.example.com/")
+	now := time.Now()
+
+	jar := New(nil)
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "c", Value: "1"},
+		{Name: "a", Value: "2"},
+		{Name: "b", Value: "3"},
+	}, now)
+	want := cookieNames(jar.cookies(u, now))
+
+	blob, err := json.Marshal(jar.Entries())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries CookieEntries
+	if err := json.Unmarshal(blob, &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := New(nil)
+	restored.SetEntries(entries)
+	got := cookieNames(restored.cookies(u, now))
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+
+	// New cookies must not reuse a restored sequence number.
+	restored.setCookies(u, []*http.Cookie{{Name: "d", Value: "4"}}, now)
+	seen := make(map[uint64]string)
+	for id, e := range restored.Entries()["example.com"] {
+		if other, ok := seen[e.SeqNum]; ok {
+			t.Fatalf("%s and %s share sequence number %d", id, other, e.SeqNum)
+		}
+		seen[e.SeqNum] = id
+	}
+}
+
+func TestLegacyEntriesAreNumbered(t *testing.T) {
+	creation := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := CookieEntries{
+		"example.com": {
+			"example.com;/;b": {Name: "b", Domain: "example.com", Path: "/", HostOnly: true, Expires: endOfTime, Creation: creation},
+			"example.com;/;a": {Name: "a", Domain: "example.com", Path: "/", HostOnly: true, Expires: endOfTime, Creation: creation},
+		},
+	}
+
+	jar := New(nil)
+	jar.SetEntries(entries)
+
+	u, _ := url.Parse("http://example.com/")
+	got := cookieNames(jar.Cookies(u))
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("expected [a b], got %v", got)
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+	u, _ := url.Parse("https://example.com/")
+	now := time.Now()
+
+	jar := New(&Options{MaxLifetime: ChromiumMaxLifetime})
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "maxage", Value: "1", MaxAge: 10 * 365 * 24 * 60 * 60},
+		{Name: "expires", Value: "1", Expires: now.Add(10 * 365 * 24 * time.Hour)},
+		{Name: "short", Value: "1", MaxAge: 60},
+		{Name: "session", Value: "1"},
+	}, now)
+
+	limit := now.Add(ChromiumMaxLifetime)
+	for id, e := range jar.Entries()["example.com"] {
+		switch e.Name {
+		case "maxage", "expires":
+			if !e.Expires.Equal(limit) {
+				t.Errorf("%s: expected expiry clamped to %v, got %v", id, limit, e.Expires)
+			}
+		case "short":
+			if !e.Expires.Equal(now.Add(time.Minute)) {
+				t.Errorf("%s: expiry should not change, got %v", id, e.Expires)
+			}
+		case "session":
+			if e.Persistent || !e.Expires.Equal(endOfTime) {
+				t.Errorf("%s: session cookie should not be clamped, got %v", id, e.Expires)
+			}
+		}
+	}
+}
+
+func TestMaxLifetimeOnLoad(t *testing.T) {
+	u, _ := url.Parse("https://example.com/")
+	store := NewMemoryStore()
+
+	long := New(&Options{Storage: store.Storage()})
+	long.SetCookies(u, []*http.Cookie{{Name: "a", Value: "1", MaxAge: 10 * 365 * 24 * 60 * 60}})
+	long.SaveCookies()
+
+	before := time.Now()
+	clamped := New(&Options{Storage: store.Storage(), MaxLifetime: ChromiumMaxLifetime})
+	for id, e := range clamped.Entries()["example.com"] {
+		if limit := time.Now().Add(ChromiumMaxLifetime); e.Expires.After(limit) || e.Expires.Before(before.Add(ChromiumMaxLifetime)) {
+			t.Errorf("%s: loaded expiry %v not clamped to %v", id, e.Expires, limit)
+		}
+	}
+}
+
+func TestNewSessionDropsSessionCookies(t *testing.T) {
+	u, _ := url.Parse("https://example.com/")
+	store := NewMemoryStore()
+
+	first := New(&Options{Storage: store.Storage()})
+	first.SetCookies(u, []*http.Cookie{
+		{Name: "session", Value: "1"},
+		{Name: "persistent", Value: "1", MaxAge: 3600},
+	})
+	first.SaveCookies()
+
+	restarted := New(&Options{Storage: store.Storage(), NewSession: true})
+	if got := cookieNames(restarted.Cookies(u)); len(got) != 1 || got[0] != "persistent" {
+		t.Fatalf("expected [persistent], got %v", got)
+	}
+
+	// Until the restarted jar saves, reloads do not bring back the session
+	// cookies of the previous session, but keep those saved since.
+	if err := restarted.loadFromStorage(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := cookieNames(restarted.Cookies(u)); len(got) != 1 {
+		t.Fatalf("expected [persistent] after reload, got %v", got)
+	}
+	other := New(&Options{Storage: store.Storage(), IgnoreInvalidations: true})
+	other.SetCookies(u, []*http.Cookie{{Name: "fresh", Value: "1"}})
+	other.SaveCookies()
+	if err := restarted.loadFromStorage(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := cookieNames(restarted.Cookies(u)); len(got) != 2 {
+		t.Fatalf("expected persistent and fresh after reload, got %v", got)
+	}
+	restarted.SetCookies(u, []*http.Cookie{{Name: "fresh", MaxAge: -1}})
+
+	// Session cookies set after the restart survive reloads.
+	restarted.SetCookies(u, []*http.Cookie{{Name: "later", Value: "1"}})
+	restarted.SaveCookies()
+	if err := restarted.loadFromStorage(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := cookieNames(restarted.Cookies(u)); len(got) != 2 {
+		t.Fatalf("expected persistent and later, got %v", got)
+	}
+
+	// Without NewSession, session cookies are restored.
+	resumed := New(&Options{Storage: store.Storage()})
+	if got := cookieNames(resumed.Cookies(u)); len(got) != 2 {
+		t.Fatalf("expected 2 cookies, got %v", got)
+	}
+}
+
+func TestCookiesRemovesExpired(t *testing.T) {
+	u, _ := url.Parse("https://example.com/")
+	now := time.Now()
+
+	jar := New(nil)
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "short", Value: "1", MaxAge: 60},
+		{Name: "long", Value: "1", MaxAge: 3600},
+	}, now)
+
+	later := now.Add(10 * time.Minute)
+	if got := cookieNames(jar.cookies(u, later)); len(got) != 1 || got[0] != "long" {
+		t.Fatalf("expected [long], got %v", got)
+	}
+	entries := jar.Entries()["example.com"]
+	if len(entries) != 1 {
+		t.Fatalf("expired entry kept after read: %v", entries)
+	}
+	for id, e := range entries {
+		if !e.LastAccess.Equal(later) {
+			t.Errorf("%s: LastAccess %v, want %v", id, e.LastAccess, later)
+		}
+	}
+}
+
+func TestLoadDoesNotModifyStorageEntries(t *testing.T) {
+	entries := CookieEntries{
+		"example.com": {
+			"example.com;/;a": {Name: "a", Domain: "example.com", Path: "/", HostOnly: true, Expires: endOfTime},
+		},
+	}
+
+	jar := New(&Options{Storage: &staticStorage{entries: entries}, IgnoreInvalidations: true})
+	if e := entries["example.com"]["example.com;/;a"]; e.SeqNum != 0 {
+		t.Errorf("loading numbered the entry of the storage: %d", e.SeqNum)
+	}
+	if e := jar.Entries()["example.com"]["example.com;/;a"]; e.SeqNum == 0 {
+		t.Error("loaded entry was not numbered")
+	}
+}
+
+// racingStorage sends an invalidation during its first load, as if another
+// writer saved the entries that later loads return.
+type racingStorage struct {
+	loads        int32
+	entries      CookieEntries
+	invalidateCh chan struct{}
+}
+
+func (r *racingStorage) Save(entries CookieEntries) error {
+	return nil
+}
+
+func (r *racingStorage) Load() (CookieEntries, error) {
+	if atomic.AddInt32(&r.loads, 1) > 1 {
+		return r.entries, nil
+	}
+	// The invalidation is dropped unless the jar listens within a second.
+	select {
+	case r.invalidateCh <- struct{}{}:
+	case <-time.After(time.Second):
+	}
+	return make(CookieEntries), nil
+}
+
+func (r *racingStorage) InvalidationEvents() <-chan struct{} {
+	return r.invalidateCh
+}
+
+func TestLoadInvalidatedDuringLoad(t *testing.T) {
+	storage := &racingStorage{entries: testEntries(), invalidateCh: make(chan struct{})}
+	jar, err := Load(&Options{Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(jar.Entries()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("invalidation during the initial load was missed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type slowStorage struct {
+	delay time.Duration
+}
+
+func (s slowStorage) Save(entries CookieEntries) error {
+	time.Sleep(s.delay)
+	return nil
+}
+
+func (s slowStorage) Load() (CookieEntries, error) {
+	return make(CookieEntries), nil
+}
+
+func (s slowStorage) InvalidationEvents() <-chan struct{} {
+	return nil
+}
+
+const benchDomains = 256
+
+func benchURLs() []*url.URL {
+	urls := make([]*url.URL, benchDomains)
+	for i := range urls {
+		urls[i], _ = url.Parse(fmt.Sprintf("https://www.site%d.com/path", i))
+	}
+	return urls
+}
+
+func benchJar(b *testing.B, o *Options) (*Jar, []*url.URL) {
+	jar := New(o)
+	urls := benchURLs()
+	for _, u := range urls {
+		jar.SetCookies(u, []*http.Cookie{
+			{Name: "session", Value: "0123456789abcdef"},
+			{Name: "pref", Value: "dark", Path: "/"},
+			{Name: "track", Value: "1", MaxAge: 3600},
+		})
+	}
+	b.ResetTimer()
+	return jar, urls
+}
+
+// The parallel benchmarks measure contention between goroutines, and are
+// meant to be compared across CPU counts, as in
+//
+//	go test -run NONE -bench Parallel -cpu 1,4,8
+func BenchmarkCookiesParallel(b *testing.B) {
+	jar, urls := benchJar(b, nil)
+	var seed int64
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+		for pb.Next() {
+			jar.Cookies(urls[rnd.Intn(len(urls))])
+		}
+	})
+}
+
+func BenchmarkMixedParallel(b *testing.B) {
+	jar, urls := benchJar(b, nil)
+	var seed int64
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+		for pb.Next() {
+			u := urls[rnd.Intn(len(urls))]
+			if rnd.Intn(10) == 0 {
+				jar.SetCookies(u, []*http.Cookie{{Name: "track", Value: "2", MaxAge: 3600}})
+			} else {
+				jar.Cookies(u)
+			}
+		}
+	})
+}
+
+// BenchmarkMixedSlowStorageParallel measures readers competing with writers
+// whose saves take a network round trip.
+func BenchmarkMixedSlowStorageParallel(b *testing.B) {
+	jar, urls := benchJar(b, &Options{
+		Storage:             slowStorage{delay: 50 * time.Microsecond},
+		SaveOnSetCookies:    true,
+		IgnoreInvalidations: true,
+	})
+	var seed int64
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+		for pb.Next() {
+			u := urls[rnd.Intn(len(urls))]
+			if rnd.Intn(100) == 0 {
+				jar.SetCookies(u, []*http.Cookie{{Name: "track", Value: "2", MaxAge: 3600}})
+			} else {
+				jar.Cookies(u)
+			}
+		}
+	})
+}
+
+// BenchmarkCookiesDuringSlowSave measures readers while the jar is
+// continuously being saved to a storage that takes a millisecond per save.
+func BenchmarkCookiesDuringSlowSave(b *testing.B) {
+	jar, urls := benchJar(b, &Options{
+		Storage:             slowStorage{delay: time.Millisecond},
+		IgnoreInvalidations: true,
+	})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				jar.SaveCookies()
+			}
+		}
+	}()
+
+	var seed int64
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+		for pb.Next() {
+			jar.Cookies(urls[rnd.Intn(len(urls))])
+		}
+	})
+
+	b.StopTimer()
+	close(stop)
+	<-done
+}
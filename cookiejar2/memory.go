@@ -0,0 +1,120 @@
+package cookiejar2
+
+import "sync"
+
+// MemoryStore holds cookie entries in memory, so that several jars in the
+// same process can share them. Each jar uses its own MemoryStorage handle
+// obtained from Storage(); a save through one handle invalidates all others.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries CookieEntries
+	handles []*MemoryStorage
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(CookieEntries)}
+}
+
+// Storage returns a new handle on the store, to be used by a single Jar. The
+// handle should be closed once the jar is no longer used.
+func (m *MemoryStore) Storage() *MemoryStorage {
+	s := &MemoryStorage{
+		store:        m,
+		invalidateCh: make(chan struct{}, 1),
+	}
+
+	m.mu.Lock()
+	m.handles = append(m.handles, s)
+	m.mu.Unlock()
+
+	return s
+}
+
+// Invalidate sends an invalidation event to every handle, causing their
+// jars to reload.
+func (m *MemoryStore) Invalidate() {
+	m.invalidate(nil)
+}
+
+// remove removes h from the handles of the store.
+func (m *MemoryStore) remove(h *MemoryStorage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, other := range m.handles {
+		if other == h {
+			m.handles = append(m.handles[:i], m.handles[i+1:]...)
+			return
+		}
+	}
+}
+
+// invalidate sends an invalidation event to every handle but except.
+func (m *MemoryStore) invalidate(except *MemoryStorage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, h := range m.handles {
+		if h == except {
+			continue
+		}
+		select {
+		case h.invalidateCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// MemoryStorage is an EntryStorage handle on a MemoryStore.
+type MemoryStorage struct {
+	store        *MemoryStore
+	invalidateCh chan struct{}
+}
+
+// Save replaces the entries of the store with a copy of entries, and
+// invalidates the other handles.
+func (s *MemoryStorage) Save(entries CookieEntries) error {
+	entries = cloneEntries(entries)
+
+	s.store.mu.Lock()
+	s.store.entries = entries
+	s.store.mu.Unlock()
+
+	s.store.invalidate(s)
+	return nil
+}
+
+// Load returns a copy of the entries of the store.
+func (s *MemoryStorage) Load() (CookieEntries, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	return cloneEntries(s.store.entries), nil
+}
+
+func (s *MemoryStorage) InvalidationEvents() <-chan struct{} {
+	return s.invalidateCh
+}
+
+// Close releases the handle, which no longer receives invalidation events.
+// It can still be loaded and saved.
+func (s *MemoryStorage) Close() error {
+	s.store.remove(s)
+	return nil
+}
+
+// cloneEntries returns a deep copy of entries.
+func cloneEntries(entries CookieEntries) CookieEntries {
+	ret := make(CookieEntries, len(entries))
+	for key, submap := range entries {
+		ck := make(map[string]Entry, len(submap))
+		for id, e := range submap {
+			ck[id] = e
+		}
+		ret[key] = ck
+	}
+	return ret
+}
+
+var _ EntryStorage = (*MemoryStorage)(nil)
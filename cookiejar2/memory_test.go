@@ -0,0 +1,65 @@
+package cookiejar2_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/rmdashrf/go-misc/cookiejar2"
+	"github.com/rmdashrf/go-misc/cookiejar2/storagetest"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) (a, b cookiejar2.EntryStorage) {
+		store := cookiejar2.NewMemoryStore()
+		return store.Storage(), store.Storage()
+	})
+}
+
+func TestMemoryStoreSharesBetweenJars(t *testing.T) {
+	store := cookiejar2.NewMemoryStore()
+	u, _ := url.Parse("http://example.com/")
+
+	jar1 := cookiejar2.New(&cookiejar2.Options{Storage: store.Storage(), SaveOnSetCookies: true})
+	jar2 := cookiejar2.New(&cookiejar2.Options{Storage: store.Storage()})
+
+	jar1.SetCookies(u, []*http.Cookie{{Name: "a", Value: "1"}})
+
+	deadline := time.Now().Add(time.Second)
+	for len(jar2.Cookies(u)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("cookie was not propagated to the second jar")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMemoryStoreInvalidate(t *testing.T) {
+	store := cookiejar2.NewMemoryStore()
+	s := store.Storage()
+
+	store.Invalidate()
+	select {
+	case <-s.InvalidationEvents():
+	case <-time.After(time.Second):
+		t.Fatal("Invalidate did not send an event")
+	}
+}
+
+func TestMemoryStorageClose(t *testing.T) {
+	store := cookiejar2.NewMemoryStore()
+	a, b := store.Storage(), store.Storage()
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Save(make(cookiejar2.CookieEntries)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-b.InvalidationEvents():
+		t.Fatal("closed handle was invalidated")
+	default:
+	}
+}
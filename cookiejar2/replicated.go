@@ -0,0 +1,328 @@
+package cookiejar2
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ReadPolicy determines how a ReplicatedStorage loads entries.
+type ReadPolicy int
+
+const (
+	// ReadFirstHealthy loads from the backends in order, and returns the
+	// entries of the first one whose Load succeeds. Backends that missed
+	// saves are tried after the others, and those that failed within the
+	// last RetryInterval last.
+	ReadFirstHealthy ReadPolicy = iota
+
+	// ReadQuorum loads from every backend and merges the results. It fails
+	// unless at least ReadQuorum of the loads succeed. Backends that missed
+	// saves are left out of the merge unless no other backend was loaded,
+	// so that the cookies deleted by those saves do not come back.
+	ReadQuorum
+)
+
+// ReplicatedOptions are the options for creating a new ReplicatedStorage.
+type ReplicatedOptions struct {
+	// ReadPolicy determines how entries are loaded.
+	ReadPolicy ReadPolicy
+
+	// ReadQuorum is the number of backends that must be loaded successfully
+	// under the ReadQuorum policy. Defaults to a majority of the backends.
+	ReadQuorum int
+
+	// Resolve merges conflicting entries under the ReadQuorum policy. If nil,
+	// PreferNewest is used.
+	Resolve ConflictResolver
+
+	// WriteQuorum is the number of backends that must be saved to
+	// successfully for Save to succeed. Defaults to 1.
+	WriteQuorum int
+
+	// RetryInterval is how long a backend whose last operation failed is
+	// tried after the others by ReadFirstHealthy, and left out of resyncs.
+	// Defaults to 30s.
+	RetryInterval time.Duration
+}
+
+// ReplicatedStorage is an EntryStorage that saves to several backends, and
+// loads from them according to a ReadPolicy. Invalidation events from every
+// backend are merged.
+//
+// Every save writes the complete set of entries to every backend, so a
+// backend that was unavailable is brought back in sync by the first save
+// after it recovers. Backends that missed saves, or whose entries differ
+// from those loaded under ReadQuorum, are also resynced by the next
+// successful Load.
+type ReplicatedStorage struct {
+	backends     []EntryStorage
+	opts         ReplicatedOptions
+	invalidateCh chan struct{}
+
+	// mu locks errs, failedAt and stale.
+	mu sync.Mutex
+
+	// errs holds the error of the last operation on each backend, and
+	// failedAt the time it failed.
+	errs     []error
+	failedAt []time.Time
+
+	// stale is set for the backends that may not hold the latest saved
+	// entries.
+	stale []bool
+
+	// saveMu serializes saves with resyncs, and locks saves, the number of
+	// saves started, so that a resync does not overwrite a later save.
+	saveMu sync.Mutex
+	saves  uint64
+}
+
+// NewReplicatedStorage returns a new ReplicatedStorage over the given
+// backends, which are ordered by preference. A nil *ReplicatedOptions is
+// equivalent to a zero ReplicatedOptions.
+func NewReplicatedStorage(o *ReplicatedOptions, backends ...EntryStorage) *ReplicatedStorage {
+	if o == nil {
+		o = &ReplicatedOptions{}
+	}
+
+	r := &ReplicatedStorage{
+		backends:     backends,
+		opts:         *o,
+		invalidateCh: make(chan struct{}, 1),
+		errs:         make([]error, len(backends)),
+		failedAt:     make([]time.Time, len(backends)),
+		stale:        make([]bool, len(backends)),
+	}
+
+	if r.opts.ReadQuorum <= 0 {
+		r.opts.ReadQuorum = len(backends)/2 + 1
+	}
+	if r.opts.WriteQuorum <= 0 {
+		r.opts.WriteQuorum = 1
+	}
+	if r.opts.Resolve == nil {
+		r.opts.Resolve = PreferNewest
+	}
+	if r.opts.RetryInterval <= 0 {
+		r.opts.RetryInterval = 30 * time.Second
+	}
+
+	for _, b := range backends {
+		if ch := b.InvalidationEvents(); ch != nil {
+			go r.forwardInvalidations(ch)
+		}
+	}
+
+	return r
+}
+
+func (r *ReplicatedStorage) forwardInvalidations(ch <-chan struct{}) {
+	for range ch {
+		select {
+		case r.invalidateCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// setErr records the result of an operation on backend i, which is a save
+// if save is set. Backends that failed are stale until a later save or
+// resync succeeds, as they may have missed saves.
+func (r *ReplicatedStorage) setErr(i int, err error, save bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.errs[i] = err
+	if err != nil {
+		r.failedAt[i] = time.Now()
+		r.stale[i] = true
+	} else if save {
+		r.stale[i] = false
+	}
+}
+
+// order returns the indexes of the backends in the order ReadFirstHealthy
+// tries them: by preference, with the stale backends after the others, and
+// those that failed within RetryInterval last.
+func (r *ReplicatedStorage) order() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var healthy, stale, failed []int
+	for i := range r.backends {
+		switch {
+		case r.coolingDown(i):
+			failed = append(failed, i)
+		case r.stale[i]:
+			stale = append(stale, i)
+		default:
+			healthy = append(healthy, i)
+		}
+	}
+	return append(append(healthy, stale...), failed...)
+}
+
+// coolingDown reports whether backend i failed within RetryInterval. mu
+// should already be locked.
+func (r *ReplicatedStorage) coolingDown(i int) bool {
+	return r.errs[i] != nil && time.Since(r.failedAt[i]) < r.opts.RetryInterval
+}
+
+// Errors returns the error of the last operation on each backend, in the
+// order the backends were given. A nil error means the backend is healthy.
+func (r *ReplicatedStorage) Errors() []error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ret := make([]error, len(r.errs))
+	copy(ret, r.errs)
+	return ret
+}
+
+// Save saves entries to every backend concurrently. It fails if fewer than
+// WriteQuorum of the saves succeed.
+func (r *ReplicatedStorage) Save(entries CookieEntries) error {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	r.saves++
+
+	errs := make([]error, len(r.backends))
+
+	var wg sync.WaitGroup
+	for i, b := range r.backends {
+		wg.Add(1)
+		go func(i int, b EntryStorage) {
+			defer wg.Done()
+			errs[i] = b.Save(entries)
+			r.setErr(i, errs[i], true)
+		}(i, b)
+	}
+	wg.Wait()
+
+	var (
+		succeeded int
+		firstErr  error
+	)
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if succeeded < r.opts.WriteQuorum {
+		return fmt.Errorf("cookiejar: saved to %d of %d backends, need %d: %w", succeeded, len(r.backends), r.opts.WriteQuorum, firstErr)
+	}
+	return nil
+}
+
+// Load loads entries according to the ReadPolicy, and then resyncs the
+// backends that are stale or diverged with the loaded entries.
+func (r *ReplicatedStorage) Load() (CookieEntries, error) {
+	r.saveMu.Lock()
+	saves := r.saves
+	r.saveMu.Unlock()
+
+	if r.opts.ReadPolicy == ReadQuorum {
+		return r.loadQuorum(saves)
+	}
+
+	var firstErr error
+	for _, i := range r.order() {
+		entries, err := r.backends[i].Load()
+		r.setErr(i, err, false)
+		if err == nil {
+			r.resync(entries, saves, func(j int) bool { return j != i && r.isStale(j) })
+			return entries, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return nil, fmt.Errorf("cookiejar: all %d backends failed to load: %w", len(r.backends), firstErr)
+}
+
+func (r *ReplicatedStorage) loadQuorum(saves uint64) (CookieEntries, error) {
+	results := make([]CookieEntries, len(r.backends))
+	errs := make([]error, len(r.backends))
+
+	var wg sync.WaitGroup
+	for i, b := range r.backends {
+		wg.Add(1)
+		go func(i int, b EntryStorage) {
+			defer wg.Done()
+			results[i], errs[i] = b.Load()
+			r.setErr(i, errs[i], false)
+		}(i, b)
+	}
+	wg.Wait()
+
+	var (
+		loaded, stale []CookieEntries
+		firstErr      error
+	)
+	for i, err := range errs {
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else if r.isStale(i) {
+			stale = append(stale, results[i])
+		} else {
+			loaded = append(loaded, results[i])
+		}
+	}
+
+	if n := len(loaded) + len(stale); n < r.opts.ReadQuorum {
+		return nil, fmt.Errorf("cookiejar: loaded from %d of %d backends, need %d: %w", n, len(r.backends), r.opts.ReadQuorum, firstErr)
+	}
+	if len(loaded) == 0 {
+		loaded = stale
+	}
+
+	merged := MergeEntries(r.opts.Resolve, loaded...)
+	r.resync(merged, saves, func(i int) bool {
+		return errs[i] == nil && (r.isStale(i) || len(DiffEntries(results[i], merged)) > 0)
+	})
+	return merged, nil
+}
+
+func (r *ReplicatedStorage) isStale(i int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stale[i]
+}
+
+// resync saves entries to the backends for which need returns true, unless
+// a save started since the entries were loaded, which was the case if the
+// number of saves is no longer saves. Backends that failed within
+// RetryInterval are left for later.
+func (r *ReplicatedStorage) resync(entries CookieEntries, saves uint64, need func(i int) bool) {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	if r.saves != saves {
+		return
+	}
+
+	for i, b := range r.backends {
+		if !need(i) {
+			continue
+		}
+		r.mu.Lock()
+		retry := !r.coolingDown(i)
+		r.mu.Unlock()
+		if retry {
+			r.setErr(i, b.Save(entries), true)
+		}
+	}
+}
+
+// InvalidationEvents returns the merged invalidation events of all backends.
+func (r *ReplicatedStorage) InvalidationEvents() <-chan struct{} {
+	return r.invalidateCh
+}
+
+var _ EntryStorage = (*ReplicatedStorage)(nil)
@@ -0,0 +1,176 @@
+package cookiejar2
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// staticStorage always loads the same entries, and can be invalidated.
+type staticStorage struct {
+	entries      CookieEntries
+	invalidateCh chan struct{}
+}
+
+func (s *staticStorage) Save(entries CookieEntries) error {
+	return nil
+}
+
+func (s *staticStorage) Load() (CookieEntries, error) {
+	return s.entries, nil
+}
+
+func (s *staticStorage) InvalidationEvents() <-chan struct{} {
+	return s.invalidateCh
+}
+
+func TestReplicatedFallback(t *testing.T) {
+	primary := &flakyStorage{failLoads: 1, failSaves: 1}
+	local := &staticStorage{entries: testEntries(), invalidateCh: make(chan struct{}, 1)}
+	r := NewReplicatedStorage(nil, primary, local)
+
+	entries, err := r.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entries["example.com"]; !ok {
+		t.Fatalf("expected entries from the fallback backend, got %v", entries)
+	}
+	if errs := r.Errors(); errs[0] == nil || errs[1] != nil {
+		t.Fatalf("unexpected backend errors: %v", errs)
+	}
+
+	// A single healthy backend satisfies the default write quorum, and the
+	// primary catches up on the next save.
+	if err := r.Save(entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Save(entries); err != nil || r.Errors()[0] != nil {
+		t.Fatalf("primary did not recover: %v, %v", err, r.Errors())
+	}
+
+	local.invalidateCh <- struct{}{}
+	select {
+	case <-r.InvalidationEvents():
+	case <-time.After(time.Second):
+		t.Fatal("invalidation was not forwarded")
+	}
+}
+
+func TestReplicatedQuorum(t *testing.T) {
+	r := NewReplicatedStorage(&ReplicatedOptions{ReadPolicy: ReadQuorum, WriteQuorum: 2},
+		&flakyStorage{failLoads: 1, failSaves: 1},
+		&staticStorage{entries: testEntries()},
+	)
+
+	if _, err := r.Load(); err == nil {
+		t.Fatal("expected load to fail without a majority")
+	}
+	if err := r.Save(testEntries()); err == nil {
+		t.Fatal("expected save to fail without the write quorum")
+	}
+
+	entries, err := r.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entries["example.com"]; !ok {
+		t.Fatalf("expected merged entries, got %v", entries)
+	}
+}
+
+func TestReplicatedSkipsFailedPrimary(t *testing.T) {
+	primary := &flakyStorage{failLoads: 100}
+	r := NewReplicatedStorage(nil, primary, &staticStorage{entries: testEntries()})
+
+	for i := 0; i < 3; i++ {
+		if _, err := r.Load(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if primary.loadAttempts != 1 {
+		t.Errorf("failed primary loaded %d times within the retry interval", primary.loadAttempts)
+	}
+
+	all := NewReplicatedStorage(nil, &flakyStorage{failLoads: 1})
+	if _, err := all.Load(); !errors.Is(err, errFlaky) {
+		t.Errorf("Load error %v does not wrap the backend error", err)
+	}
+}
+
+func TestReplicatedResyncOnLoad(t *testing.T) {
+	primary := &flakyStorage{failSaves: 1}
+	r := NewReplicatedStorage(&ReplicatedOptions{RetryInterval: time.Nanosecond},
+		primary, &staticStorage{entries: testEntries()})
+
+	if err := r.Save(testEntries()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The primary missed the save, so the entries are loaded from the
+	// replica, and written back to the primary.
+	entries, err := r.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entries["example.com"]; !ok {
+		t.Fatalf("loaded from the stale primary: %v", entries)
+	}
+	if primary.loadAttempts != 0 || primary.saveAttempts != 2 || r.Errors()[0] != nil {
+		t.Fatalf("primary was not resynced: %d loads, %d saves, %v", primary.loadAttempts, primary.saveAttempts, r.Errors())
+	}
+
+	if _, err := r.Load(); err != nil || primary.loadAttempts != 1 {
+		t.Fatalf("resynced primary not preferred: %v, %d loads", err, primary.loadAttempts)
+	}
+}
+
+// downStorage fails every operation while down.
+type downStorage struct {
+	*MemoryStorage
+	down bool
+}
+
+func (d *downStorage) Save(entries CookieEntries) error {
+	if d.down {
+		return errFlaky
+	}
+	return d.MemoryStorage.Save(entries)
+}
+
+func (d *downStorage) Load() (CookieEntries, error) {
+	if d.down {
+		return nil, errFlaky
+	}
+	return d.MemoryStorage.Load()
+}
+
+func TestReplicatedQuorumIgnoresStale(t *testing.T) {
+	a, b := NewMemoryStore().Storage(), NewMemoryStore().Storage()
+	c := &downStorage{MemoryStorage: NewMemoryStore().Storage()}
+	r := NewReplicatedStorage(&ReplicatedOptions{ReadPolicy: ReadQuorum, RetryInterval: time.Nanosecond}, a, b, c)
+
+	if err := r.Save(testEntries()); err != nil {
+		t.Fatal(err)
+	}
+	c.down = true
+	if err := r.Save(make(CookieEntries)); err != nil {
+		t.Fatal(err)
+	}
+	c.down = false
+
+	// The cookies deleted while c was down do not come back, and c is
+	// resynced.
+	entries, err := r.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("deleted cookies came back: %v", entries)
+	}
+	for i, s := range []EntryStorage{a, b, c} {
+		if entries, _ := s.Load(); len(entries) != 0 {
+			t.Errorf("backend %d holds %v", i, entries)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package cookiejar2
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// ScopedJar is an http.CookieJar view of a Jar that can only read and write
+// the cookies of an allowed set of sites. Requests to any other site get no
+// cookies, and cookies they set are dropped.
+//
+// Sites are identified by their eTLD+1, the key under which the Jar stores
+// their cookies. A cookie can only be set for the eTLD+1 of the URL it was
+// received from, so checking the URL is enough to keep every site's cookies
+// out of reach of the others.
+type ScopedJar struct {
+	jar  *Jar
+	keys map[string]bool
+}
+
+// Scoped returns a view of the jar restricted to the sites of the given
+// domains. Each domain is reduced to its eTLD+1, so "www.example.com" allows
+// every host under example.com. Domains that are not valid host names are
+// ignored.
+func (j *Jar) Scoped(domains ...string) *ScopedJar {
+	s := &ScopedJar{
+		jar:  j,
+		keys: make(map[string]bool, len(domains)),
+	}
+
+	for _, d := range domains {
+		host, err := canonicalHost(d)
+		if err != nil || host == "" {
+			continue
+		}
+		s.keys[jarKey(host, j.psList)] = true
+	}
+
+	return s
+}
+
+// Keys returns the sorted eTLD+1 keys the view is restricted to.
+func (s *ScopedJar) Keys() []string {
+	keys := make([]string, 0, len(s.keys))
+	for k := range s.keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// allowed reports whether the cookies of u are visible through the view.
+func (s *ScopedJar) allowed(u *url.URL) bool {
+	host, err := canonicalHost(u.Host)
+	if err != nil {
+		return false
+	}
+	return s.keys[jarKey(host, s.jar.psList)]
+}
+
+// SetCookies implements the SetCookies method of the http.CookieJar
+// interface. Cookies from sites outside of the view are dropped.
+func (s *ScopedJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	if !s.allowed(u) {
+		return
+	}
+	s.jar.SetCookies(u, cookies)
+}
+
+// Cookies implements the Cookies method of the http.CookieJar interface. It
+// returns no cookies for sites outside of the view.
+func (s *ScopedJar) Cookies(u *url.URL) []*http.Cookie {
+	if !s.allowed(u) {
+		return nil
+	}
+	return s.jar.Cookies(u)
+}
+
+var _ http.CookieJar = (*ScopedJar)(nil)
@@ -0,0 +1,37 @@
+package cookiejar2
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestScopedJar(t *testing.T) {
+	jar := New(nil)
+	allowed, _ := url.Parse("https://www.example.com/")
+	sibling, _ := url.Parse("https://api.example.com:8443/")
+	other, _ := url.Parse("https://other.org/")
+
+	jar.SetCookies(other, []*http.Cookie{{Name: "secret", Value: "1"}})
+
+	scoped := jar.Scoped("WWW.Example.com.")
+	if keys := scoped.Keys(); len(keys) != 1 || keys[0] != "example.com" {
+		t.Fatalf("expected [example.com], got %v", keys)
+	}
+
+	if got := scoped.Cookies(other); len(got) != 0 {
+		t.Fatalf("read cookies outside of scope: %v", got)
+	}
+	scoped.SetCookies(other, []*http.Cookie{{Name: "secret", Value: "overwritten"}})
+	if got := jar.Cookies(other); len(got) != 1 || got[0].Value != "1" {
+		t.Fatalf("wrote cookies outside of scope: %v", got)
+	}
+
+	scoped.SetCookies(allowed, []*http.Cookie{{Name: "session", Value: "2", Domain: "example.com"}})
+	if got := cookieNames(scoped.Cookies(sibling)); len(got) != 1 || got[0] != "session" {
+		t.Fatalf("expected [session], got %v", got)
+	}
+	if got := cookieNames(jar.Cookies(allowed)); len(got) != 1 || got[0] != "session" {
+		t.Fatalf("cookie not set in parent jar, got %v", got)
+	}
+}
@@ -0,0 +1,155 @@
+package cookiejar2
+
+import (
+	"sync"
+	"time"
+)
+
+// numShards is the number of shards the entries of a Jar are split into.
+const numShards = 32
+
+// shard holds the entries of the eTLD+1 keys that hash to it.
+type shard struct {
+	// mu locks entries. Cookies() only takes it for reading.
+	mu sync.RWMutex
+
+	// entries is a set of entries, keyed by their eTLD+1 and subkeyed by
+	// their name/domain/path. The submaps are copied on write, so that
+	// snapshots can share them with the shard.
+	entries CookieEntries
+
+	// accessMu locks accessed.
+	accessMu sync.Mutex
+
+	// accessed holds the LastAccess updates made by Cookies() that have not
+	// been applied to entries yet, keyed like entries.
+	accessed map[string]map[string]time.Time
+}
+
+// shardIndex returns the index of the shard that holds key.
+func shardIndex(key string) int {
+	// 32-bit FNV-1a, inlined to avoid allocating a hash.Hash per lookup.
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % numShards)
+}
+
+// recordAccess records that the entries with the given ids under key were
+// sent at now. The shard must not be locked for writing by the caller.
+func (s *shard) recordAccess(key string, ids []string, now time.Time) {
+	s.accessMu.Lock()
+	defer s.accessMu.Unlock()
+
+	if s.accessed == nil {
+		s.accessed = make(map[string]map[string]time.Time)
+	}
+
+	submap := s.accessed[key]
+	if submap == nil {
+		submap = make(map[string]time.Time)
+		s.accessed[key] = submap
+	}
+
+	for _, id := range ids {
+		submap[id] = now
+	}
+}
+
+// applyAccess applies all pending LastAccess updates to entries. mu should
+// already be locked for writing.
+func (s *shard) applyAccess() {
+	s.accessMu.Lock()
+	accessed := s.accessed
+	s.accessed = nil
+	s.accessMu.Unlock()
+
+	for key, times := range accessed {
+		if submap, ok := s.entries[key]; ok {
+			s.entries[key] = withAccess(submap, times)
+		}
+	}
+}
+
+// removeExpired removes the persistent entries under key that expired at now,
+// and reports whether there were any. mu should already be locked for
+// writing.
+func (s *shard) removeExpired(key string, now time.Time) bool {
+	// The submap may be shared with a snapshot, so replace it with a copy.
+	submap := make(map[string]Entry, len(s.entries[key]))
+	for id, e := range s.entries[key] {
+		if !e.Persistent || e.Expires.After(now) {
+			submap[id] = e
+		}
+	}
+	if len(submap) == len(s.entries[key]) {
+		return false
+	}
+
+	if len(submap) == 0 {
+		delete(s.entries, key)
+	} else {
+		s.entries[key] = submap
+	}
+	return true
+}
+
+// hasAccess reports whether there are pending LastAccess updates.
+func (s *shard) hasAccess() bool {
+	s.accessMu.Lock()
+	defer s.accessMu.Unlock()
+	return len(s.accessed) > 0
+}
+
+// takeAccess removes and returns the pending LastAccess updates for key. mu
+// should already be locked for writing.
+func (s *shard) takeAccess(key string) map[string]time.Time {
+	s.accessMu.Lock()
+	defer s.accessMu.Unlock()
+
+	times := s.accessed[key]
+	delete(s.accessed, key)
+	return times
+}
+
+// withAccess returns a copy of submap with the given LastAccess updates
+// applied.
+func withAccess(submap map[string]Entry, times map[string]time.Time) map[string]Entry {
+	ret := make(map[string]Entry, len(submap))
+	for id, e := range submap {
+		if t, ok := times[id]; ok && t.After(e.LastAccess) {
+			e.LastAccess = t
+		}
+		ret[id] = e
+	}
+	return ret
+}
+
+// snapshotEntries adds the entries of the shard to dst, including the pending
+// LastAccess updates. Submaps without pending updates are shared with the
+// shard and must not be modified. mu should already be locked for reading.
+func (s *shard) snapshotEntries(dst CookieEntries) {
+	s.accessMu.Lock()
+	defer s.accessMu.Unlock()
+
+	for key, submap := range s.entries {
+		if times, ok := s.accessed[key]; ok {
+			dst[key] = withAccess(submap, times)
+		} else {
+			dst[key] = submap
+		}
+	}
+}
+
+// copyEntries adds a copy of the entries of the shard to dst, including the
+// pending LastAccess updates. mu should already be locked for reading.
+func (s *shard) copyEntries(dst CookieEntries) {
+	s.accessMu.Lock()
+	defer s.accessMu.Unlock()
+
+	for key, submap := range s.entries {
+		dst[key] = withAccess(submap, s.accessed[key])
+	}
+}
@@ -0,0 +1,85 @@
+package cookiejar2
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// SiteStats are statistics about the cookies of one eTLD+1.
+type SiteStats struct {
+	// Count is the number of cookies stored for the site.
+	Count int
+
+	// Bytes is the size of the site's entries as serialized by
+	// MarshalEntries, without the key itself.
+	Bytes int
+}
+
+// Stats are statistics about the cookies held by a Jar.
+type Stats struct {
+	// Sites holds the statistics of every eTLD+1 with cookies.
+	Sites map[string]SiteStats
+
+	// Count is the total number of cookies, split into Session and
+	// Persistent ones. Expired is the number of persistent cookies that
+	// have expired but were not yet removed; they are included in Count.
+	Count      int
+	Session    int
+	Persistent int
+	Expired    int
+
+	// SoonestExpiry is the earliest expiry of a persistent cookie that has
+	// not expired yet, or zero if there is none.
+	SoonestExpiry time.Time
+
+	// LeastRecentlyUsed is the cookie with the oldest LastAccess, which is
+	// updated every time the cookie is returned by Cookies. It is the zero
+	// Entry if the jar is empty.
+	LeastRecentlyUsed Entry
+
+	// Size is the size of all entries as serialized by MarshalEntries,
+	// which is what a blob-based EntryStorage stores.
+	Size int
+}
+
+// Stats returns statistics about the cookies in the jar. It works on a
+// snapshot of the entries and does not copy them.
+func (j *Jar) Stats() (Stats, error) {
+	entries := j.snapshot()
+	now := time.Now()
+
+	st := Stats{Sites: make(map[string]SiteStats, len(entries))}
+	for key, submap := range entries {
+		data, err := json.Marshal(submap)
+		if err != nil {
+			return Stats{}, err
+		}
+		st.Sites[key] = SiteStats{Count: len(submap), Bytes: len(data)}
+
+		for _, e := range submap {
+			st.Count++
+			if !e.Persistent {
+				st.Session++
+			} else {
+				st.Persistent++
+				if !e.Expires.After(now) {
+					st.Expired++
+				} else if st.SoonestExpiry.IsZero() || e.Expires.Before(st.SoonestExpiry) {
+					st.SoonestExpiry = e.Expires
+				}
+			}
+
+			if st.Count == 1 || e.LastAccess.Before(st.LeastRecentlyUsed.LastAccess) {
+				st.LeastRecentlyUsed = e
+			}
+		}
+	}
+
+	data, err := MarshalEntries(entries)
+	if err != nil {
+		return Stats{}, err
+	}
+	st.Size = len(data)
+
+	return st, nil
+}
@@ -0,0 +1,51 @@
+package cookiejar2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	now := time.Now()
+	example, _ := url.Parse("https://www.example.com/")
+	other, _ := url.Parse("https://other.org/")
+
+	jar := New(nil)
+	jar.setCookies(example, []*http.Cookie{
+		{Name: "session", Value: "1"},
+		{Name: "soon", Value: "1", MaxAge: 60},
+		{Name: "later", Value: "1", MaxAge: 2 * 3600},
+	}, now.Add(-time.Hour))
+	jar.setCookies(other, []*http.Cookie{{Name: "a", Value: "1"}}, now)
+
+	st, err := jar.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st.Count != 4 || st.Session != 2 || st.Persistent != 2 || st.Expired != 1 {
+		t.Errorf("unexpected counts %+v", st)
+	}
+	if want := now.Add(time.Hour); !st.SoonestExpiry.Equal(want) {
+		t.Errorf("expected soonest expiry %v, got %v", want, st.SoonestExpiry)
+	}
+	if st.LeastRecentlyUsed.Domain != "www.example.com" {
+		t.Errorf("expected least recently used cookie from www.example.com, got %+v", st.LeastRecentlyUsed)
+	}
+
+	if len(st.Sites) != 2 || st.Sites["example.com"].Count != 3 || st.Sites["other.org"].Count != 1 {
+		t.Errorf("unexpected sites %+v", st.Sites)
+	}
+	data, _ := json.Marshal(jar.Entries()["other.org"])
+	if st.Sites["other.org"].Bytes != len(data) {
+		t.Errorf("expected other.org to be %d bytes, got %d", len(data), st.Sites["other.org"].Bytes)
+	}
+
+	blob, _ := MarshalEntries(jar.Entries())
+	if st.Size != len(blob) {
+		t.Errorf("expected size %d, got %d", len(blob), st.Size)
+	}
+}
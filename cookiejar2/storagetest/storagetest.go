@@ -0,0 +1,312 @@
+// Package storagetest checks implementations of cookiejar2.EntryStorage
+// against the contract documented on the interface.
+package storagetest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rmdashrf/go-misc/cookiejar2"
+)
+
+// How long to wait for an invalidation event that is expected, and for one
+// that must not arrive.
+const (
+	invalidationTimeout = 2 * time.Second
+	quietPeriod         = 200 * time.Millisecond
+)
+
+// Factory returns two storages backed by the same, initially empty, store,
+// as two processes sharing it would. The storages must be ready to receive
+// invalidation events when Factory returns. Storages that implement
+// io.Closer are closed when the test that created them finishes.
+type Factory func(t *testing.T) (a, b cookiejar2.EntryStorage)
+
+// Run runs the conformance suite as subtests of t, calling newPair for a
+// fresh store in each of them.
+func Run(t *testing.T, newPair Factory) {
+	newPair = closing(newPair)
+	t.Run("EmptyLoad", func(t *testing.T) { testEmptyLoad(t, newPair) })
+	t.Run("RoundTrip", func(t *testing.T) { testRoundTrip(t, newPair) })
+	t.Run("SaveDoesNotModify", func(t *testing.T) { testSaveDoesNotModify(t, newPair) })
+	t.Run("NoSelfInvalidation", func(t *testing.T) { testNoSelfInvalidation(t, newPair) })
+	t.Run("InvalidatesOthers", func(t *testing.T) { testInvalidatesOthers(t, newPair) })
+	t.Run("Concurrent", func(t *testing.T) { testConcurrent(t, newPair) })
+}
+
+// closing returns a Factory that registers the storages returned by newPair
+// to be closed on cleanup.
+func closing(newPair Factory) Factory {
+	return func(t *testing.T) (a, b cookiejar2.EntryStorage) {
+		a, b = newPair(t)
+		for _, s := range []cookiejar2.EntryStorage{a, b} {
+			if c, ok := s.(io.Closer); ok {
+				t.Cleanup(func() { c.Close() })
+			}
+		}
+		return a, b
+	}
+}
+
+// Entries returns a set of entries exercising every Entry field, including
+// non-UTC times with sub-second precision and non-ASCII values.
+func Entries() cookiejar2.CookieEntries {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	creation := time.Date(2024, 3, 1, 10, 30, 0, 123456789, loc)
+
+	return cookiejar2.CookieEntries{
+		"example.com": {
+			"example.com;/;session": {
+				Name:       "session",
+				Value:      "abc=def; ghi",
+				Domain:     "example.com",
+				Path:       "/",
+				SameSite:   http.SameSiteLaxMode,
+				Secure:     true,
+				HttpOnly:   true,
+				Persistent: true,
+				HostOnly:   true,
+				Expires:    creation.Add(400 * 24 * time.Hour),
+				Creation:   creation,
+				LastAccess: creation.Add(time.Minute),
+				SeqNum:     1,
+			},
+			"example.com;/app;lang": {
+				Name:       "lang",
+				Value:      "grüße",
+				Domain:     "example.com",
+				Path:       "/app",
+				SameSite:   http.SameSiteStrictMode,
+				Creation:   creation.Add(time.Second),
+				LastAccess: creation.Add(time.Second),
+				SeqNum:     2,
+			},
+		},
+		"example.org": {
+			"www.example.org;/;id": {
+				Name:       "id",
+				Value:      "",
+				Domain:     "www.example.org",
+				Path:       "/",
+				SameSite:   http.SameSiteNoneMode,
+				Secure:     true,
+				Persistent: true,
+				Expires:    time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+				Creation:   creation.Add(2 * time.Second),
+				LastAccess: creation.Add(3 * time.Second),
+				SeqNum:     3,
+			},
+		},
+	}
+}
+
+// Equal reports whether a and b hold the same entries, comparing times with
+// time.Time.Equal.
+func Equal(a, b cookiejar2.CookieEntries) bool {
+	return diff(a, b) == ""
+}
+
+// diff describes the first difference between want and got, or returns ""
+// if they are equal.
+func diff(want, got cookiejar2.CookieEntries) string {
+	for key, submap := range want {
+		for id, w := range submap {
+			g, ok := got[key][id]
+			if !ok {
+				return fmt.Sprintf("missing %s %s", key, id)
+			}
+			if !equalEntry(w, g) {
+				return fmt.Sprintf("%s %s: got %+v, want %+v", key, id, g, w)
+			}
+		}
+	}
+	for key, submap := range got {
+		for id := range submap {
+			if _, ok := want[key][id]; !ok {
+				return fmt.Sprintf("unexpected %s %s", key, id)
+			}
+		}
+	}
+	return ""
+}
+
+func equalEntry(a, b cookiejar2.Entry) bool {
+	return a.Name == b.Name &&
+		a.Value == b.Value &&
+		a.Domain == b.Domain &&
+		a.Path == b.Path &&
+		a.SameSite == b.SameSite &&
+		a.Secure == b.Secure &&
+		a.HttpOnly == b.HttpOnly &&
+		a.Persistent == b.Persistent &&
+		a.HostOnly == b.HostOnly &&
+		a.Expires.Equal(b.Expires) &&
+		a.Creation.Equal(b.Creation) &&
+		a.LastAccess.Equal(b.LastAccess) &&
+		a.SeqNum == b.SeqNum
+}
+
+func load(t *testing.T, s cookiejar2.EntryStorage) cookiejar2.CookieEntries {
+	t.Helper()
+	entries, err := s.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return entries
+}
+
+func save(t *testing.T, s cookiejar2.EntryStorage, entries cookiejar2.CookieEntries) {
+	t.Helper()
+	if err := s.Save(entries); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+}
+
+// drain discards pending invalidation events of s.
+func drain(s cookiejar2.EntryStorage) {
+	ch := s.InvalidationEvents()
+	for {
+		select {
+		case <-ch:
+		case <-time.After(quietPeriod):
+			return
+		}
+	}
+}
+
+func testEmptyLoad(t *testing.T, newPair Factory) {
+	a, _ := newPair(t)
+	if entries := load(t, a); len(entries) != 0 {
+		t.Fatalf("new store loaded %d keys, want none", len(entries))
+	}
+}
+
+func testRoundTrip(t *testing.T, newPair Factory) {
+	a, b := newPair(t)
+
+	save(t, a, Entries())
+	if d := diff(Entries(), load(t, a)); d != "" {
+		t.Errorf("load from saving storage: %s", d)
+	}
+	if d := diff(Entries(), load(t, b)); d != "" {
+		t.Errorf("load from other storage: %s", d)
+	}
+
+	// Saving replaces all entries.
+	save(t, b, cookiejar2.CookieEntries{})
+	if entries := load(t, a); len(entries) != 0 {
+		t.Errorf("loaded %d keys after saving none", len(entries))
+	}
+}
+
+func testSaveDoesNotModify(t *testing.T, newPair Factory) {
+	a, _ := newPair(t)
+
+	entries := Entries()
+	save(t, a, entries)
+	if d := diff(Entries(), entries); d != "" {
+		t.Fatalf("Save modified its argument: %s", d)
+	}
+
+	// Modifying a loaded set must not affect the store.
+	loaded := load(t, a)
+	delete(loaded, "example.com")
+	loaded["example.org"]["www.example.org;/;id"] = cookiejar2.Entry{}
+	if d := diff(Entries(), load(t, a)); d != "" {
+		t.Fatalf("modifying loaded entries changed the store: %s", d)
+	}
+}
+
+func testNoSelfInvalidation(t *testing.T, newPair Factory) {
+	a, _ := newPair(t)
+	ch := a.InvalidationEvents()
+	if ch == nil {
+		t.Skip("storage has no invalidation events")
+	}
+	drain(a)
+
+	save(t, a, Entries())
+	select {
+	case <-ch:
+		t.Fatal("Save invalidated the saving storage")
+	case <-time.After(quietPeriod):
+	}
+}
+
+func testInvalidatesOthers(t *testing.T, newPair Factory) {
+	a, b := newPair(t)
+	ch := b.InvalidationEvents()
+	if ch == nil {
+		t.Skip("storage has no invalidation events")
+	}
+	drain(b)
+
+	save(t, a, Entries())
+	select {
+	case <-ch:
+	case <-time.After(invalidationTimeout):
+		t.Fatal("Save did not invalidate the other storage")
+	}
+}
+
+func testConcurrent(t *testing.T, newPair Factory) {
+	a, b := newPair(t)
+
+	// Every writer saves its own distinguishable set, so that a load can be
+	// checked for being one of them rather than a mix.
+	const writers = 4
+	sets := make([]cookiejar2.CookieEntries, writers)
+	for i := range sets {
+		sets[i] = Entries()
+		e := sets[i]["example.com"]["example.com;/;session"]
+		e.Value = fmt.Sprintf("writer %d", i)
+		sets[i]["example.com"]["example.com;/;session"] = e
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4*writers*10)
+	for i, s := range []cookiejar2.EntryStorage{a, b, a, b} {
+		wg.Add(2)
+		go func(i int, s cookiejar2.EntryStorage) {
+			defer wg.Done()
+			for n := 0; n < 10; n++ {
+				if err := s.Save(sets[i]); err != nil {
+					errs <- err
+				}
+			}
+		}(i, s)
+		go func(s cookiejar2.EntryStorage) {
+			defer wg.Done()
+			for n := 0; n < 10; n++ {
+				entries, err := s.Load()
+				if err != nil {
+					errs <- err
+					continue
+				}
+				if len(entries) == 0 {
+					continue
+				}
+				matched := false
+				for _, set := range sets {
+					if Equal(set, entries) {
+						matched = true
+						break
+					}
+				}
+				if !matched {
+					errs <- fmt.Errorf("loaded entries match no saved set: %+v", entries)
+				}
+			}
+		}(s)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
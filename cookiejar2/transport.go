@@ -0,0 +1,250 @@
+package cookiejar2
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// SavePolicy determines when a Transport persists its jar to storage.
+type SavePolicy int
+
+const (
+	// SaveNever leaves persistence to the caller, either through
+	// SaveCookies() or the SaveOnSetCookies option of the jar.
+	SaveNever SavePolicy = iota
+
+	// SaveEveryResponse saves the jar after every response that carried
+	// cookies.
+	SaveEveryResponse
+
+	// SaveDebounced saves the jar SaveDelay after the first response that
+	// carried cookies. Responses received in the meantime are covered by the
+	// same save.
+	SaveDebounced
+
+	// SaveOnIdle saves the jar once no response has carried cookies for
+	// SaveDelay.
+	SaveOnIdle
+)
+
+// TransportOptions are the options for creating a new Transport.
+type TransportOptions struct {
+	// Base is the RoundTripper used to make the actual requests. If nil,
+	// http.DefaultTransport is used.
+	Base http.RoundTripper
+
+	// SavePolicy determines when the jar is saved to its storage.
+	SavePolicy SavePolicy
+
+	// SaveDelay is the delay used by the SaveDebounced and SaveOnIdle
+	// policies. Defaults to one second.
+	SaveDelay time.Duration
+}
+
+// Transport is an http.RoundTripper that sends and stores cookies from a Jar
+// on every request it makes.
+//
+// Since http.Client calls its transport once per hop, cookies set by the
+// responses of followed redirects are stored as well, as are cookies set by
+// informational (1xx) responses such as 103 Early Hints. Clients using a
+// Transport should leave http.Client.Jar unset, otherwise cookies will be
+// sent twice.
+type Transport struct {
+	jar    *Jar
+	base   http.RoundTripper
+	policy SavePolicy
+	delay  time.Duration
+
+	// mu locks timer and gen. gen is incremented whenever a timer is
+	// armed, so that a timer that fired late does not clear its successor.
+	mu    sync.Mutex
+	timer *time.Timer
+	gen   uint64
+}
+
+// NewTransport returns a new Transport that uses jar. A nil *TransportOptions
+// is equivalent to a zero TransportOptions.
+func NewTransport(jar *Jar, o *TransportOptions) *Transport {
+	if o == nil {
+		o = &TransportOptions{}
+	}
+
+	t := &Transport{
+		jar:    jar,
+		base:   o.Base,
+		policy: o.SavePolicy,
+		delay:  o.SaveDelay,
+	}
+
+	if t.base == nil {
+		t.base = http.DefaultTransport
+	}
+
+	if t.delay <= 0 {
+		t.delay = time.Second
+	}
+
+	return t
+}
+
+// RoundTrip implements the http.RoundTripper interface. The request is not
+// modified; the cookies of the jar are added to a copy of it.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := CookieTraceFromContext(req.Context())
+	hop := CookieHop{URL: req.URL}
+
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			received := t.storeCookies(req.URL, http.Header(header))
+			hop.Received = append(hop.Received, received...)
+			return nil
+		},
+	})
+
+	outreq := req.Clone(ctx)
+	hop.Sent = t.jar.Cookies(req.URL)
+	for _, c := range hop.Sent {
+		outreq.AddCookie(c)
+	}
+
+	resp, err := t.base.RoundTrip(outreq)
+	if err != nil {
+		if trace != nil {
+			trace.add(hop)
+		}
+		return nil, err
+	}
+
+	received := t.storeCookies(req.URL, resp.Header)
+	hop.Received = append(hop.Received, received...)
+	hop.StatusCode = resp.StatusCode
+	if trace != nil {
+		trace.add(hop)
+	}
+
+	return resp, nil
+}
+
+// storeCookies saves the cookies set by header into the jar, and returns them.
+func (t *Transport) storeCookies(u *url.URL, header http.Header) []*http.Cookie {
+	cookies := (&http.Response{Header: header}).Cookies()
+	if len(cookies) == 0 {
+		return nil
+	}
+
+	t.jar.SetCookies(u, cookies)
+	t.cookiesChanged()
+	return cookies
+}
+
+func (t *Transport) cookiesChanged() {
+	switch t.policy {
+	case SaveEveryResponse:
+		t.jar.SaveCookies()
+	case SaveDebounced, SaveOnIdle:
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if t.timer == nil {
+			t.gen++
+			gen := t.gen
+			t.timer = time.AfterFunc(t.delay, func() { t.timerFired(gen) })
+		} else if t.policy == SaveOnIdle && t.timer.Stop() {
+			// If Stop fails, the timer already fired and the pending save
+			// will include the cookies that were just stored.
+			t.timer.Reset(t.delay)
+		}
+	}
+}
+
+// timerFired saves the jar when the timer armed as generation gen fires. The
+// timer is only cleared if it is still the armed one: Flush may have run
+// while it fired, and a new timer been armed since.
+func (t *Transport) timerFired(gen uint64) {
+	t.mu.Lock()
+	if t.gen == gen {
+		t.timer = nil
+	}
+	t.mu.Unlock()
+
+	t.jar.SaveCookies()
+}
+
+// Flush immediately saves the jar if a save is pending under the
+// SaveDebounced or SaveOnIdle policies. It should be called before the
+// program exits.
+func (t *Transport) Flush() {
+	t.mu.Lock()
+	pending := t.timer != nil && t.timer.Stop()
+	t.timer = nil
+	t.mu.Unlock()
+
+	if pending {
+		t.jar.SaveCookies()
+	}
+}
+
+// CookieHop records the cookies exchanged during a single request made by a
+// Transport.
+type CookieHop struct {
+	// URL is the URL of the request.
+	URL *url.URL
+
+	// StatusCode is the status code of the final response, or 0 if the
+	// request failed.
+	StatusCode int
+
+	// Sent are the cookies that were sent with the request.
+	Sent []*http.Cookie
+
+	// Received are the cookies that were set by the response, including
+	// those set by informational responses.
+	Received []*http.Cookie
+}
+
+// CookieTrace collects the cookies exchanged by a Transport for every request
+// made with a context returned by WithCookieTrace. Redirects followed by
+// http.Client share the context of the original request, so each hop is
+// recorded.
+type CookieTrace struct {
+	mu   sync.Mutex
+	hops []CookieHop
+}
+
+type cookieTraceKey struct{}
+
+// WithCookieTrace returns a copy of ctx that records cookie exchanges into
+// the returned CookieTrace.
+func WithCookieTrace(ctx context.Context) (context.Context, *CookieTrace) {
+	trace := &CookieTrace{}
+	return context.WithValue(ctx, cookieTraceKey{}, trace), trace
+}
+
+// CookieTraceFromContext returns the CookieTrace associated with ctx, or nil
+// if there is none.
+func CookieTraceFromContext(ctx context.Context) *CookieTrace {
+	trace, _ := ctx.Value(cookieTraceKey{}).(*CookieTrace)
+	return trace
+}
+
+// Hops returns the hops recorded so far, in the order their responses were
+// received.
+func (c *CookieTrace) Hops() []CookieHop {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ret := make([]CookieHop, len(c.hops))
+	copy(ret, c.hops)
+	return ret
+}
+
+func (c *CookieTrace) add(hop CookieHop) {
+	c.mu.Lock()
+	c.hops = append(c.hops, hop)
+	c.mu.Unlock()
+}
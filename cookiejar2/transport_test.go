@@ -0,0 +1,229 @@
+package cookiejar2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type countingStorage struct {
+	mu    sync.Mutex
+	saves int
+	last  CookieEntries
+}
+
+func (c *countingStorage) Save(entries CookieEntries) error {
+	c.mu.Lock()
+	c.saves++
+	c.last = entries
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *countingStorage) Load() (CookieEntries, error) {
+	return make(CookieEntries), nil
+}
+
+func (c *countingStorage) InvalidationEvents() <-chan struct{} {
+	return nil
+}
+
+func (c *countingStorage) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.saves
+}
+
+func newRedirectServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		http.Redirect(w, r, "/home", http.StatusFound)
+	})
+	mux.HandleFunc("/home", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie("session"); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "seen", Value: "1"})
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestTransportRedirectTrace(t *testing.T) {
+	srv := newRedirectServer()
+	defer srv.Close()
+
+	storage := &countingStorage{}
+	jar := New(&Options{Storage: storage, IgnoreInvalidations: true})
+	client := &http.Client{
+		Transport: NewTransport(jar, &TransportOptions{SavePolicy: SaveEveryResponse}),
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/login", nil)
+	ctx, trace := WithCookieTrace(req.Context())
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("session cookie was not sent after redirect: %d", resp.StatusCode)
+	}
+
+	hops := trace.Hops()
+	if len(hops) != 2 {
+		t.Fatalf("expected 2 hops, got %d", len(hops))
+	}
+	if len(hops[0].Sent) != 0 || len(hops[0].Received) != 1 || hops[0].StatusCode != http.StatusFound {
+		t.Errorf("unexpected first hop: %+v", hops[0])
+	}
+	if len(hops[1].Sent) != 1 || hops[1].Sent[0].Name != "session" || len(hops[1].Received) != 1 {
+		t.Errorf("unexpected second hop: %+v", hops[1])
+	}
+
+	if n := storage.count(); n != 2 {
+		t.Errorf("expected 2 saves, got %d", n)
+	}
+}
+
+func TestTransportSaveOnIdle(t *testing.T) {
+	srv := newRedirectServer()
+	defer srv.Close()
+
+	storage := &countingStorage{}
+	jar := New(&Options{Storage: storage, IgnoreInvalidations: true})
+	tr := NewTransport(jar, &TransportOptions{
+		SavePolicy: SaveOnIdle,
+		SaveDelay:  50 * time.Millisecond,
+	})
+	client := &http.Client{Transport: tr}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(srv.URL + "/login")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if n := storage.count(); n != 0 {
+		t.Fatalf("saved before idle: %d", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if n := storage.count(); n != 1 {
+		t.Fatalf("expected a single save, got %d", n)
+	}
+
+	tr.Flush()
+	if n := storage.count(); n != 1 {
+		t.Fatalf("flush without pending changes saved: %d", n)
+	}
+}
+
+func TestTransportLateTimer(t *testing.T) {
+	srv := newRedirectServer()
+	defer srv.Close()
+
+	storage := &countingStorage{}
+	jar := New(&Options{Storage: storage, IgnoreInvalidations: true})
+	tr := NewTransport(jar, &TransportOptions{
+		SavePolicy: SaveDebounced,
+		SaveDelay:  time.Hour,
+	})
+	client := &http.Client{Transport: tr}
+
+	resp, err := client.Get(srv.URL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// A timer armed before the current one fires late, after a Flush.
+	tr.mu.Lock()
+	stale := tr.gen - 1
+	tr.mu.Unlock()
+	tr.timerFired(stale)
+	saves := storage.count()
+
+	tr.Flush()
+	if n := storage.count(); n != saves+1 {
+		t.Fatalf("flush after a late timer saved %d times, want 1", n-saves)
+	}
+}
+
+func TestTransportEarlyHints(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "hint=1")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Set-Cookie")
+		http.SetCookie(w, &http.Cookie{Name: "final", Value: "2"})
+	}))
+	defer srv.Close()
+
+	jar := New(&Options{IgnoreInvalidations: true})
+	client := &http.Client{Transport: NewTransport(jar, nil)}
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	ctx, trace := WithCookieTrace(req.Context())
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	hops := trace.Hops()
+	if len(hops) != 1 || len(hops[0].Received) != 2 || hops[0].Received[0].Name != "hint" {
+		t.Fatalf("unexpected hops: %+v", hops)
+	}
+	if cookies := jar.Cookies(req.URL); len(cookies) != 2 {
+		t.Errorf("expected the cookies of both responses, got %v", cookies)
+	}
+}
+
+func TestTransportSaveDebounced(t *testing.T) {
+	srv := newRedirectServer()
+	defer srv.Close()
+
+	storage := &countingStorage{}
+	jar := New(&Options{Storage: storage, IgnoreInvalidations: true})
+	tr := NewTransport(jar, &TransportOptions{
+		SavePolicy: SaveDebounced,
+		SaveDelay:  50 * time.Millisecond,
+	})
+	client := &http.Client{Transport: tr}
+
+	// Both responses of the redirect are covered by a single save.
+	resp, err := client.Get(srv.URL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if n := storage.count(); n != 0 {
+		t.Fatalf("saved before the delay: %d", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	storage.mu.Lock()
+	saves, saved := storage.saves, len(storage.last["127.0.0.1"])
+	storage.mu.Unlock()
+	if saves != 1 || saved != 2 {
+		t.Fatalf("expected a single save of 2 cookies, got %d saves of %d", saves, saved)
+	}
+
+	// The next response arms a new save.
+	resp, err = client.Get(srv.URL + "/home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	time.Sleep(150 * time.Millisecond)
+	if n := storage.count(); n != 2 {
+		t.Fatalf("expected a second save, got %d", n)
+	}
+}
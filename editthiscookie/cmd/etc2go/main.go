@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -34,7 +35,9 @@ func mostSignificantDomain(e []*editthiscookie.Entry) (*url.URL, error) {
 	maxDomain := ""
 
 	for d, c := range domainCounts {
-		if c > maxCount {
+		// Break ties by name, so that the output does not depend on map
+		// iteration order.
+		if c > maxCount || (c == maxCount && d < maxDomain) {
 			maxCount = c
 			maxDomain = d
 		}
@@ -49,13 +52,38 @@ func mostSignificantDomain(e []*editthiscookie.Entry) (*url.URL, error) {
 
 }
 
+// exportEntries converts cookiejar2 entries back into EditThisCookie JSON, so
+// that they can be imported into a browser.
+func exportEntries(contents []byte) {
+	entries, err := cookiejar2.UnmarshalEntries(contents)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read entries: %v", err)
+		os.Exit(1)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(editthiscookie.FromEntries(entries)); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode: %v", err)
+		os.Exit(1)
+	}
+}
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s cookiefile", os.Args[0])
+	export := flag.Bool("export", false, "convert cookiejar2 entries to EditThisCookie JSON instead")
+	stable := flag.Bool("stable", false, "omit Creation and LastAccess, for output that is committed to version control")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-export | -stable] cookiefile\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	cookieFile := os.Args[1]
+	cookieFile := flag.Arg(0)
 	var r io.Reader
 	if cookieFile == "-" {
 		r = os.Stdin
@@ -76,6 +104,11 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *export {
+		exportEntries(contents)
+		return
+	}
+
 	var etcentries []*editthiscookie.Entry
 	if err := json.Unmarshal(contents, &etcentries); err != nil {
 		fmt.Fprintf(os.Stderr, "failed to read json: %v", err)
@@ -97,8 +130,9 @@ func main() {
 	cj.SetCookies(msd, gocookies)
 	cjEntries := cj.Entries()
 
-	enc := json.NewEncoder(os.Stdout)
+	enc := cookiejar2.NewEncoder(os.Stdout)
 	enc.SetIndent("", "    ")
+	enc.SetOmitVolatile(*stable)
 	if err := enc.Encode(cjEntries); err != nil {
 		fmt.Fprintf(os.Stderr, "failed to encode: %v", err)
 		os.Exit(1)
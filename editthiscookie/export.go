@@ -0,0 +1,117 @@
+package editthiscookie
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/rmdashrf/go-misc/cookiejar2"
+)
+
+// Values of Entry.SameSite, as used by the chrome.cookies API.
+const (
+	SameSiteNoRestriction = "no_restriction"
+	SameSiteLax           = "lax"
+	SameSiteStrict        = "strict"
+	SameSiteUnspecified   = "unspecified"
+)
+
+func sameSiteName(s http.SameSite) string {
+	switch s {
+	case http.SameSiteLaxMode:
+		return SameSiteLax
+	case http.SameSiteStrictMode:
+		return SameSiteStrict
+	case http.SameSiteNoneMode:
+		return SameSiteNoRestriction
+	}
+	return SameSiteUnspecified
+}
+
+// SameSiteMode returns the SameSite attribute of the entry, which GoCookie
+// does not set. SameSiteUnspecified is 0, as for cookies without the
+// attribute.
+func (e *Entry) SameSiteMode() http.SameSite {
+	switch e.SameSite {
+	case SameSiteLax:
+		return http.SameSiteLaxMode
+	case SameSiteStrict:
+		return http.SameSiteStrictMode
+	case SameSiteNoRestriction:
+		return http.SameSiteNoneMode
+	}
+	return 0
+}
+
+// MarshalJSON encodes the entry with the field names of the chrome.cookies
+// API, which the extension expects when importing.
+func (e Entry) MarshalJSON() ([]byte, error) {
+	type exported struct {
+		Domain         string  `json:"domain"`
+		ExpirationDate float64 `json:"expirationDate,omitempty"`
+		HostOnly       bool    `json:"hostOnly"`
+		HttpOnly       bool    `json:"httpOnly"`
+		Name           string  `json:"name"`
+		Path           string  `json:"path"`
+		SameSite       string  `json:"sameSite"`
+		Secure         bool    `json:"secure"`
+		Session        bool    `json:"session"`
+		StoreId        string  `json:"storeId"`
+		Value          string  `json:"value"`
+		Id             int     `json:"id"`
+	}
+	return json.Marshal(exported(e))
+}
+
+// FromEntry converts a cookiejar2 entry into an EditThisCookie entry.
+func FromEntry(e cookiejar2.Entry) Entry {
+	ret := Entry{
+		Domain:   e.Domain,
+		HostOnly: e.HostOnly,
+		HttpOnly: e.HttpOnly,
+		Name:     e.Name,
+		Path:     e.Path,
+		SameSite: sameSiteName(e.SameSite),
+		Secure:   e.Secure,
+		Session:  !e.Persistent,
+		Value:    e.Value,
+	}
+
+	// Browsers report domain cookies with a leading dot.
+	if !e.HostOnly {
+		ret.Domain = "." + e.Domain
+	}
+
+	if e.Persistent {
+		ret.ExpirationDate = float64(e.Expires.UnixNano()) / 1e9
+	}
+
+	return ret
+}
+
+// FromEntries converts all cookies of a jar into EditThisCookie entries,
+// sorted by domain, path and name, and numbered from 1.
+func FromEntries(entries cookiejar2.CookieEntries) []Entry {
+	var ret []Entry
+	for _, submap := range entries {
+		for _, e := range submap {
+			ret = append(ret, FromEntry(e))
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Domain != ret[j].Domain {
+			return ret[i].Domain < ret[j].Domain
+		}
+		if ret[i].Path != ret[j].Path {
+			return ret[i].Path < ret[j].Path
+		}
+		return ret[i].Name < ret[j].Name
+	})
+
+	for i := range ret {
+		ret[i].Id = i + 1
+	}
+
+	return ret
+}
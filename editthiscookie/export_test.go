@@ -0,0 +1,69 @@
+package editthiscookie
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/rmdashrf/go-misc/cookiejar2"
+)
+
+func TestExportRoundTrip(t *testing.T) {
+	u, _ := url.Parse("https://www.example.com/")
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	jar := cookiejar2.New(nil)
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "host", Value: "1", HttpOnly: true, SameSite: http.SameSiteStrictMode},
+		{Name: "domain", Value: "2", Domain: "example.com", Secure: true, Expires: expires},
+	})
+
+	exported := FromEntries(jar.Entries())
+	if len(exported) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(exported))
+	}
+
+	domain, host := exported[0], exported[1]
+	if domain.Domain != ".example.com" || domain.HostOnly || domain.Session || !domain.Secure ||
+		int64(domain.ExpirationDate) != expires.Unix() || domain.SameSite != SameSiteUnspecified {
+		t.Errorf("unexpected domain cookie: %+v", domain)
+	}
+	if host.Domain != "www.example.com" || !host.HostOnly || !host.Session || !host.HttpOnly ||
+		host.ExpirationDate != 0 || host.SameSite != SameSiteStrict {
+		t.Errorf("unexpected host cookie: %+v", host)
+	}
+
+	if mode := host.SameSiteMode(); mode != http.SameSiteStrictMode {
+		t.Errorf("SameSite of host cookie imported as %v", mode)
+	}
+	if mode := domain.SameSiteMode(); mode != 0 {
+		t.Errorf("unspecified SameSite imported as %v, want 0", mode)
+	}
+
+	blob, err := json.Marshal(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields []map[string]interface{}
+	if err := json.Unmarshal(blob, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields[0]["expirationDate"]; !ok {
+		t.Errorf("domain cookie exported without expirationDate: %s", blob)
+	}
+	if _, ok := fields[1]["expirationDate"]; ok {
+		t.Errorf("session cookie exported with expirationDate: %s", blob)
+	}
+
+	var imported []Entry
+	if err := json.Unmarshal(blob, &imported); err != nil {
+		t.Fatal(err)
+	}
+	jar = cookiejar2.New(nil)
+	jar.SetCookies(u, []*http.Cookie{imported[0].GoCookie()})
+	if n := len(jar.Cookies(u)); n != 1 {
+		t.Fatalf("expected the persistent cookie after import, got %d", n)
+	}
+}
@@ -0,0 +1,247 @@
+package rediscookiestore
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/rmdashrf/go-misc/cookiejar2"
+)
+
+// Store layouts reported in StoreInfo.
+const (
+	LayoutBlob = "blob"
+	LayoutHash = "hash"
+)
+
+// StoreInfo describes a store found by ScanStores.
+type StoreInfo struct {
+	// Key is the key of the store, as passed to NewRedisCookieStore or
+	// NewHashCookieStore.
+	Key string
+
+	// Layout is LayoutBlob for a RedisCookieStore, and LayoutHash for a
+	// HashCookieStore.
+	Layout string
+
+	// Cookies is the number of cookies, and Size the size of their
+	// serialized form in bytes.
+	Cookies int
+	Size    int64
+
+	// Rev is the revision of the store, and LastWrite the time of its last
+	// save. LastWrite is zero for stores last saved before it was recorded.
+	Rev       int64
+	LastWrite time.Time
+
+	// Idle is the time since the store was last accessed, as reported by
+	// OBJECT IDLETIME, for stores whose LastWrite is zero. It is zero if it
+	// is unknown, such as under an LFU maxmemory-policy. Loading a store
+	// resets it, as does StoreStat once it has read it.
+	Idle time.Duration
+
+	// SoonestExpiry is the earliest expiry of a persistent cookie, zero if
+	// there is none.
+	SoonestExpiry time.Time
+
+	// Err is set if the entries could not be decoded, such as when they are
+	// encrypted. Cookies and SoonestExpiry are then unknown.
+	Err error
+}
+
+// scanKeys calls fn with every key matching match, on every master of a
+// Redis Cluster. fn may be called concurrently.
+func scanKeys(client redis.UniversalClient, match string, fn func(key string)) error {
+	scan := func(c redis.Cmdable) error {
+		iter := c.Scan(0, match, 100).Iterator()
+		for iter.Next() {
+			fn(iter.Val())
+		}
+		return iter.Err()
+	}
+
+	if cluster, ok := client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(func(c *redis.Client) error {
+			return scan(c)
+		})
+	}
+	return scan(client)
+}
+
+// ScanStores returns the stores whose keys match the glob pattern match, such
+// as "accounts:*", sorted by key. Stores whose key has a hash tag must be
+// matched including it, as in "{accounts:*".
+func ScanStores(client redis.UniversalClient, match string) ([]StoreInfo, error) {
+	keys, err := scanStoreKeys(client, match)
+	if err != nil {
+		return nil, err
+	}
+
+	stores := make([]StoreInfo, 0, len(keys))
+	for _, key := range keys {
+		info, err := StoreStat(client, key)
+		if err == redis.Nil {
+			// Deleted since the scan.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		stores = append(stores, info)
+	}
+	return stores, nil
+}
+
+// scanStoreKeys returns the keys of the stores whose keys match the glob
+// pattern match, sorted.
+func scanStoreKeys(client redis.UniversalClient, match string) ([]string, error) {
+	var (
+		mu   sync.Mutex
+		keys []string
+	)
+	err := scanKeys(client, StoreName(match), func(name string) {
+		mu.Lock()
+		keys = append(keys, strings.TrimSuffix(name, ":store"))
+		mu.Unlock()
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+// StoreStat describes the store with the given key. It returns redis.Nil if
+// there is no such store.
+func StoreStat(client redis.UniversalClient, key string) (StoreInfo, error) {
+	info := StoreInfo{Key: key}
+
+	// The idle time is read first, as reading the store resets it.
+	idle, idleErr := client.ObjectIdleTime(StoreName(key)).Result()
+
+	typ, err := client.Type(StoreName(key)).Result()
+	if err != nil {
+		return info, err
+	}
+
+	var entries cookiejar2.CookieEntries
+	switch typ {
+	case "string":
+		info.Layout = LayoutBlob
+		contents, err := client.Get(StoreName(key)).Bytes()
+		if err != nil {
+			return info, err
+		}
+		info.Size = int64(len(contents))
+		entries, info.Err = cookiejar2.UnmarshalEntries(contents)
+	case "set":
+		info.Layout = LayoutHash
+		encoded, _, err := loadHash(client, key)
+		if err != nil {
+			return info, err
+		}
+		for _, submap := range encoded {
+			for _, val := range submap {
+				info.Size += int64(len(val))
+			}
+		}
+		entries, info.Err = encoded.decode()
+	default:
+		return info, redis.Nil
+	}
+
+	meta, err := client.HGetAll(MetaName(key)).Result()
+	if err != nil {
+		return info, err
+	}
+	info.Rev = parseRev(meta["rev"])
+	if written := parseRev(meta["written"]); written > 0 {
+		info.LastWrite = fromUnixMillis(written)
+	} else if idleErr == nil {
+		info.Idle = idle
+	}
+
+	for _, submap := range entries {
+		for _, e := range submap {
+			info.Cookies++
+			if e.Persistent && (info.SoonestExpiry.IsZero() || e.Expires.Before(info.SoonestExpiry)) {
+				info.SoonestExpiry = e.Expires
+			}
+		}
+	}
+
+	return info, nil
+}
+
+var (
+	// ADMINDELETE <storekey> <metakey> <streamkey> <leasekey> <historykey> <hashprefix> <before> <idle>
+	// deletes the store and its history, unless it is leased, or unless its
+	// last write is at or after <before>. If the last write is unknown, the
+	// store is kept unless OBJECT IDLETIME of <storekey> is at least <idle>
+	// milliseconds. <before> may be empty to delete the store regardless of
+	// its last write. Returns 1 if the store was deleted.
+	scriptAdminDeleteSrc = `
+local store, meta, stream, lease, history = KEYS[1], KEYS[2], KEYS[3], KEYS[4], KEYS[5]
+if ARGV[2] ~= "" then
+	local written = tonumber(redis.call("HGET", meta, "written"))
+	if written then
+		if written >= tonumber(ARGV[2]) then
+			return 0
+		end
+	else
+		-- Read before anything else accesses the store key, which would
+		-- reset it. It fails under an LFU maxmemory-policy.
+		local idle = redis.pcall("OBJECT", "IDLETIME", store)
+		if type(idle) ~= "number" or idle * 1000 < tonumber(ARGV[3]) then
+			return 0
+		end
+	end
+end
+if redis.call("EXISTS", lease) == 1 then
+	return 0
+end
+if redis.call("TYPE", store).ok == "set" then
+	for _, domain in ipairs(redis.call("SMEMBERS", store)) do
+		redis.call("DEL", ARGV[1] .. domain)
+	end
+end
+return redis.call("DEL", store, meta, stream, history)
+`
+	scriptAdminDelete = redis.NewScript(scriptAdminDeleteSrc)
+)
+
+// DeleteStore deletes the store with the given key and reports whether it
+// was deleted. Stores with a held Lease are not deleted.
+func DeleteStore(client redis.UniversalClient, key string) (bool, error) {
+	return deleteStore(client, key, "", 0)
+}
+
+func deleteStore(client redis.UniversalClient, key string, before interface{}, idle time.Duration) (bool, error) {
+	keys := []string{StoreName(key), MetaName(key), StreamName(key), LeaseName(key), HistoryName(key)}
+	n, err := scriptAdminDelete.Run(client, keys, DomainName(key, ""), before, int64(idle/time.Millisecond)).Int64()
+	return n > 0, err
+}
+
+// DeleteIdleStores deletes the stores whose keys match the glob pattern
+// match, and whose last save is older than idle, and returns their keys.
+// Stores with a held Lease are kept. Stores last saved before the time of
+// saves was recorded are deleted if they were not accessed for idle, as
+// reported by OBJECT IDLETIME, and kept if that is unknown. The stores are
+// not read, so that their idle time is left as it is.
+func DeleteIdleStores(client redis.UniversalClient, match string, idle time.Duration) ([]string, error) {
+	keys, err := scanStoreKeys(client, match)
+	if err != nil {
+		return nil, err
+	}
+
+	before := time.Now().Add(-idle)
+	var deleted []string
+	for _, key := range keys {
+		ok, err := deleteStore(client, key, unixMillis(before), idle)
+		if err != nil {
+			return deleted, err
+		}
+		if ok {
+			deleted = append(deleted, key)
+		}
+	}
+	return deleted, nil
+}
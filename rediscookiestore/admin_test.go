@@ -0,0 +1,121 @@
+package rediscookiestore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/rmdashrf/go-misc/cookiejar2"
+	"github.com/rmdashrf/go-misc/cookiejar2/storagetest"
+)
+
+func TestAdmin(t *testing.T) {
+	cl, newKey := testClient(t)
+
+	ns := newKey("testAdmin")
+	blob, hash, leased := ns+":blob", ns+":hash", ns+":leased"
+	entries := storagetest.Entries()
+	for _, s := range []interface {
+		cookiejar2.EntryStorage
+		Close() error
+	}{
+		NewRedisCookieStore(cl, blob),
+		NewHashCookieStore(cl, hash),
+		NewRedisCookieStore(cl, leased),
+	} {
+		if err := s.Save(entries); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+	}
+
+	stores, err := ScanStores(cl, ns+":*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stores) != 3 {
+		t.Fatalf("found %d stores, want 3: %+v", len(stores), stores)
+	}
+	soonest := entries["example.com"]["example.com;/;session"].Expires
+	for i, want := range []struct{ key, layout string }{{blob, LayoutBlob}, {hash, LayoutHash}, {leased, LayoutBlob}} {
+		info := stores[i]
+		if info.Key != want.key || info.Layout != want.layout {
+			t.Errorf("store %d is %s (%s), want %s (%s)", i, info.Key, info.Layout, want.key, want.layout)
+		}
+		if info.Err != nil || info.Cookies != 3 || info.Size == 0 || info.Rev != 1 {
+			t.Errorf("%s: %+v", info.Key, info)
+		}
+		if !info.SoonestExpiry.Equal(soonest) {
+			t.Errorf("%s: soonest expiry %v, want %v", info.Key, info.SoonestExpiry, soonest)
+		}
+		if time.Since(info.LastWrite) > time.Minute {
+			t.Errorf("%s: last write %v", info.Key, info.LastWrite)
+		}
+	}
+
+	// Only idle stores that are not leased are deleted.
+	deleted, err := DeleteIdleStores(cl, ns+":*", time.Hour)
+	if err != nil || len(deleted) != 0 {
+		t.Fatalf("deleted %v of recently saved stores: %v", deleted, err)
+	}
+	for _, key := range []string{hash, leased} {
+		cl.HSet(MetaName(key), "written", unixMillis(time.Now().Add(-2*time.Hour)))
+	}
+	lease, err := AcquireLease(cl, leased, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lease.Release()
+
+	deleted, err = DeleteIdleStores(cl, ns+":*", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != hash {
+		t.Fatalf("deleted %v, want [%s]", deleted, hash)
+	}
+	if n, _ := cl.Exists(StoreName(hash), MetaName(hash), DomainName(hash, "example.com"), DomainName(hash, "example.org")).Result(); n != 0 {
+		t.Errorf("%d keys of the deleted store remain", n)
+	}
+
+	if ok, err := DeleteStore(cl, blob); !ok || err != nil {
+		t.Fatalf("DeleteStore = %v, %v", ok, err)
+	}
+	if _, err := StoreStat(cl, blob); err != redis.Nil {
+		t.Errorf("StoreStat of deleted store = %v, want redis.Nil", err)
+	}
+}
+
+func TestDeleteIdleStoresWithoutLastWrite(t *testing.T) {
+	cl, newKey := testClient(t)
+
+	// A store last saved before the time of saves was recorded.
+	key := newKey("testAdminIdle")
+	if err := SetCookies(cl, key, storagetest.Entries(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	cl.HDel(MetaName(key), "written")
+
+	deleted, err := DeleteIdleStores(cl, key, time.Hour)
+	if err != nil || len(deleted) != 0 {
+		t.Fatalf("deleted %v of recently accessed store: %v", deleted, err)
+	}
+
+	// Its idle time is used instead.
+	time.Sleep(1100 * time.Millisecond)
+	info, err := StoreStat(cl, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.LastWrite.IsZero() || info.Idle < time.Second {
+		t.Errorf("last write %v, idle %v, want an idle time", info.LastWrite, info.Idle)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	deleted, err = DeleteIdleStores(cl, key, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != key {
+		t.Fatalf("deleted %v, want [%s]", deleted, key)
+	}
+}
@@ -0,0 +1,377 @@
+// Command cookiestore-admin lists and cleans up the cookie stores kept in
+// Redis by rediscookiestore, and inspects and restores the versions kept of
+// stores saved with rediscookiestore.WithHistory.
+//
+// Stores are selected by a glob pattern matching their keys, such as
+// "accounts:*". Redis is given with -redis as
+// redis://[:password@]host:port[,host:port...]/db[?master=name].
+// Versions are given by their revision, where 0 is the current contents.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/rmdashrf/go-misc/rediscookiestore"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+// commands is filled in by init, as the commands refer to it for their usage.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"list":    {"list [-redis url] [-idle d] pattern", list},
+		"prune":   {"prune [-redis url] [-n] -idle d pattern", prune},
+		"delete":  {"delete [-redis url] key...", del},
+		"history": {"history [-redis url] key", history},
+		"show":    {"show [-redis url] key rev", show},
+		"diff":    {"diff [-redis url] key old [new]", diff},
+		"restore": {"restore [-redis url] [-history n] [-lease] key rev", restore},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s command [arguments]\n\nCommands:\n", os.Args[0])
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "cookiestore-admin %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// flagSet returns a flag set for the named command that exits on errors,
+// with the -redis flag. The returned function connects to the given Redis.
+func flagSet(name string) (*flag.FlagSet, func() (redis.UniversalClient, error)) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s\n", os.Args[0], commands[name].usage)
+		fs.PrintDefaults()
+	}
+
+	url := fs.String("redis", "redis://localhost:6379", "connect to the Redis at `url`")
+	connect := func() (redis.UniversalClient, error) {
+		opts, err := rediscookiestore.ParseURL(*url)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", rediscookiestore.RedactURL(*url), err)
+		}
+		return redis.NewUniversalClient(opts), nil
+	}
+	return fs, connect
+}
+
+// parseArgs parses args into fs, and exits with a usage message unless
+// exactly n positional arguments remain, or at least -n if n is negative.
+func parseArgs(fs *flag.FlagSet, args []string, n int) []string {
+	fs.Parse(args)
+	if (n >= 0 && fs.NArg() != n) || (n < 0 && fs.NArg() < -n) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return fs.Args()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// idleStores returns the stores last saved more than idle ago, or, if their
+// last save is unknown, last accessed more than idle ago.
+func idleStores(stores []rediscookiestore.StoreInfo, idle time.Duration) []rediscookiestore.StoreInfo {
+	before := time.Now().Add(-idle)
+	var ret []rediscookiestore.StoreInfo
+	for _, info := range stores {
+		if info.LastWrite.IsZero() && info.Idle >= idle || !info.LastWrite.IsZero() && info.LastWrite.Before(before) {
+			ret = append(ret, info)
+		}
+	}
+	return ret
+}
+
+// formatLastWrite formats the last write of a store, or its idle time if
+// the last write is unknown.
+func formatLastWrite(info rediscookiestore.StoreInfo) string {
+	if info.LastWrite.IsZero() && info.Idle > 0 {
+		return fmt.Sprintf("- (idle %v)", info.Idle)
+	}
+	return formatTime(info.LastWrite)
+}
+
+func printStores(stores []rediscookiestore.StoreInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tLAYOUT\tCOOKIES\tSIZE\tREV\tLAST WRITE\tSOONEST EXPIRY")
+	for _, info := range stores {
+		cookies := fmt.Sprint(info.Cookies)
+		if info.Err != nil {
+			cookies = "?"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n", info.Key, info.Layout, cookies, info.Size,
+			info.Rev, formatLastWrite(info), formatTime(info.SoonestExpiry))
+	}
+	w.Flush()
+}
+
+func list(args []string) error {
+	fs, connect := flagSet("list")
+	idle := fs.Duration("idle", 0, "only list stores last saved, or accessed if that is unknown, more than `d` ago")
+	args = parseArgs(fs, args, 1)
+
+	client, err := connect()
+	if err != nil {
+		return err
+	}
+	stores, err := rediscookiestore.ScanStores(client, args[0])
+	if err != nil {
+		return err
+	}
+	if *idle > 0 {
+		stores = idleStores(stores, *idle)
+	}
+
+	printStores(stores)
+	return nil
+}
+
+func prune(args []string) error {
+	fs, connect := flagSet("prune")
+	dryRun := fs.Bool("n", false, "list the stores that would be deleted, without deleting them")
+	idle := fs.Duration("idle", 0, "delete stores last saved, or accessed if that is unknown, more than `d` ago")
+	args = parseArgs(fs, args, 1)
+	if *idle <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	client, err := connect()
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		stores, err := rediscookiestore.ScanStores(client, args[0])
+		if err != nil {
+			return err
+		}
+		printStores(idleStores(stores, *idle))
+		return nil
+	}
+
+	deleted, err := rediscookiestore.DeleteIdleStores(client, args[0], *idle)
+	for _, key := range deleted {
+		fmt.Println(key)
+	}
+	return err
+}
+
+func del(args []string) error {
+	fs, connect := flagSet("delete")
+	args = parseArgs(fs, args, -1)
+
+	client, err := connect()
+	if err != nil {
+		return err
+	}
+	for _, key := range args {
+		ok, err := rediscookiestore.DeleteStore(client, key)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		if !ok {
+			fmt.Fprintf(os.Stderr, "%s: no such store, or leased\n", key)
+		}
+	}
+	return nil
+}
+
+// loadVersion loads the version of key at the revision given by rev.
+func loadVersion(client redis.UniversalClient, key, rev string) (rediscookiestore.Version, error) {
+	n, err := strconv.ParseInt(rev, 10, 64)
+	if err != nil || n < 0 {
+		return rediscookiestore.Version{}, fmt.Errorf("invalid revision %q", rev)
+	}
+
+	v, err := rediscookiestore.LoadVersion(client, key, n)
+	if err == redis.Nil {
+		return v, fmt.Errorf("%s: no revision %d", key, n)
+	}
+	return v, err
+}
+
+func history(args []string) error {
+	fs, connect := flagSet("history")
+	args = parseArgs(fs, args, 1)
+
+	client, err := connect()
+	if err != nil {
+		return err
+	}
+	versions, err := rediscookiestore.History(client, args[0])
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "REV\tTIME\tWRITER\tCOOKIES\tSIZE")
+	for _, v := range versions {
+		cookies := "?"
+		if entries, err := v.Entries(); err == nil {
+			n := 0
+			for _, submap := range entries {
+				n += len(submap)
+			}
+			cookies = fmt.Sprint(n)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\n", v.Rev, formatTime(v.Time), v.Writer, cookies, len(v.Contents))
+	}
+	return w.Flush()
+}
+
+func show(args []string) error {
+	fs, connect := flagSet("show")
+	args = parseArgs(fs, args, 2)
+
+	client, err := connect()
+	if err != nil {
+		return err
+	}
+	v, err := loadVersion(client, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	entries, err := v.Entries()
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Rev %d, saved %s by %s\n", v.Rev, formatTime(v.Time), v.Writer)
+	for _, key := range keys {
+		ids := make([]string, 0, len(entries[key]))
+		for id := range entries[key] {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		fmt.Fprintf(w, "%s (%d)\n", key, len(ids))
+		for _, id := range ids {
+			e := entries[key][id]
+			expires := "session"
+			if e.Persistent {
+				expires = formatTime(e.Expires)
+			}
+			fmt.Fprintf(w, "  %s\t%q\t%s\n", id, e.Value, expires)
+		}
+	}
+	return w.Flush()
+}
+
+func diff(args []string) error {
+	fs, connect := flagSet("diff")
+	fs.Parse(args)
+	if fs.NArg() != 2 && fs.NArg() != 3 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	args = fs.Args()
+	if len(args) == 2 {
+		args = append(args, "0")
+	}
+
+	client, err := connect()
+	if err != nil {
+		return err
+	}
+	var versions [2]rediscookiestore.Version
+	for i, rev := range args[1:] {
+		if versions[i], err = loadVersion(client, args[0], rev); err != nil {
+			return err
+		}
+	}
+
+	d, err := rediscookiestore.DiffVersions(versions[0], versions[1])
+	if err != nil {
+		return err
+	}
+	return d.Format(os.Stdout)
+}
+
+func restore(args []string) error {
+	fs, connect := flagSet("restore")
+	keep := fs.Int64("history", -1, "record the restore in the history of the store, trimmed to `n` versions, or to its current length if negative")
+	leased := fs.Bool("lease", false, "acquire the lease of the store for the restore, failing if it is held")
+	args = parseArgs(fs, args, 2)
+
+	client, err := connect()
+	if err != nil {
+		return err
+	}
+	rev, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || rev <= 0 {
+		return fmt.Errorf("invalid revision %q", args[1])
+	}
+
+	if *keep < 0 {
+		if *keep, err = client.LLen(rediscookiestore.HistoryName(args[0])).Result(); err != nil {
+			return err
+		}
+	}
+	opts := []rediscookiestore.Option{rediscookiestore.WithHistory(*keep)}
+	if *leased {
+		lease, err := rediscookiestore.AcquireLease(client, args[0], 10*time.Second)
+		if err != nil {
+			return err
+		}
+		defer lease.Release()
+		opts = append(opts, rediscookiestore.WithLease(lease))
+	}
+
+	newRev, err := rediscookiestore.Restore(client, args[0], rev, opts...)
+	if err == redis.Nil {
+		return fmt.Errorf("%s: no revision %d", args[0], rev)
+	} else if err != nil {
+		return err
+	}
+	fmt.Printf("restored revision %d as %d\n", rev, newRev)
+	return nil
+}
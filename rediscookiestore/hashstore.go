@@ -0,0 +1,380 @@
+package rediscookiestore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/rmdashrf/go-misc/cookiejar2"
+)
+
+var (
+	// HASHSAVE <domainset> <pubkey> <metakey> <streamkey> <leasekey> <domainhash>... <token> <changes> <base> <maxlen> <fence> <now> <ttl> <hashprefix>
+	// applies <changes>, a JSON array of DomainChanges with one element per
+	// <domainhash>, keeps <domainset> in sync with the domains that have
+	// cookies, updates <metakey> and publishes an Invalidation from <token>
+	// to <pubkey> and <streamkey> like SETANDPUB.
+	// The changes are included as the delta if the new revision directly
+	// follows <base>. Returns the new revision. <fence> is checked against
+	// <leasekey> like SETANDPUB. The expiry of <domainset>, <metakey>,
+	// <streamkey> and the hash <hashprefix><domain> of every domain in
+	// <domainset> is set according to <ttl>, and the revisions of <metakey>
+	// are started from <now>, like SETANDPUB.
+	scriptHashSaveSrc = `
+local domains = KEYS[1]
+local publish_key = KEYS[2]
+local meta_key = KEYS[3]
+local stream_key = KEYS[4]
+local lease_key = KEYS[5]
+local token = ARGV[1]
+local changes = cjson.decode(ARGV[2])
+local base = tonumber(ARGV[3])
+local maxlen = tonumber(ARGV[4])
+local fence = ARGV[5]
+local now = ARGV[6]
+local ttl = tonumber(ARGV[7])
+
+if fence ~= "" and redis.call("GET", lease_key) ~= fence then
+	return redis.error_reply("FENCED lease not held")
+end
+
+for i, c in ipairs(changes) do
+	local hash = KEYS[i + 5]
+	if c.upserts then
+		for id, val in pairs(c.upserts) do
+			redis.call("HSET", hash, id, val)
+		end
+	end
+	if c.deletes then
+		for _, id in ipairs(c.deletes) do
+			redis.call("HDEL", hash, id)
+		end
+	end
+
+	if redis.call("HLEN", hash) == 0 then
+		redis.call("SREM", domains, c.domain)
+	else
+		redis.call("SADD", domains, c.domain)
+	end
+end
+
+if ttl ~= 0 and redis.call("HEXISTS", meta_key, "rev") == 0 then
+	redis.call("HSET", meta_key, "rev", now)
+end
+local rev = redis.call("HINCRBY", meta_key, "rev", 1)
+redis.call("HSET", meta_key, "written", now)
+local msg = '{"writer":' .. cjson.encode(token) .. ',"rev":' .. rev
+if base == rev - 1 then
+	msg = msg .. ',"delta":' .. ARGV[2]
+end
+msg = msg .. "}"
+redis.call("PUBLISH", publish_key, msg)
+if maxlen > 0 then
+	redis.call("XADD", stream_key, "MAXLEN", "~", maxlen, "*", "msg", msg)
+end
+if ttl ~= 0 then
+	local keys = {domains, meta_key, stream_key}
+	for _, domain in ipairs(redis.call("SMEMBERS", domains)) do
+		keys[#keys + 1] = ARGV[8] .. domain
+	end
+	for _, key in ipairs(keys) do
+		if ttl > 0 then
+			redis.call("PEXPIRE", key, ttl)
+		else
+			redis.call("PERSIST", key)
+		end
+	end
+end
+return rev
+`
+	scriptHashSave = redis.NewScript(scriptHashSaveSrc)
+
+	// HASHTOUCH <domainset> <metakey> <streamkey> <ttl> <hashprefix>
+	// sets the expiry of the keys of a hash store according to <ttl> like
+	// HASHSAVE, without saving.
+	scriptHashTouchSrc = `
+local ttl = tonumber(ARGV[1])
+local keys = {KEYS[1], KEYS[2], KEYS[3]}
+for _, domain in ipairs(redis.call("SMEMBERS", KEYS[1])) do
+	keys[#keys + 1] = ARGV[2] .. domain
+end
+for _, key in ipairs(keys) do
+	if ttl > 0 then
+		redis.call("PEXPIRE", key, ttl)
+	else
+		redis.call("PERSIST", key)
+	end
+end
+return 0
+`
+	scriptHashTouch = redis.NewScript(scriptHashTouchSrc)
+
+	// HASHLOAD <domainset> <metakey> <hashprefix>
+	// returns the "rev" field of <metakey>, followed by the domains in
+	// <domainset>, each followed by the contents of the hash
+	// <hashprefix><domain>, in a single atomic read. The hashes are not
+	// declared as keys, as the domains are only known to the script; on a
+	// Redis Cluster, the store key must have a hash tag so that they are on
+	// the same node.
+	scriptHashLoadSrc = `
+local ret = {redis.call("HGET", KEYS[2], "rev")}
+for _, domain in ipairs(redis.call("SMEMBERS", KEYS[1])) do
+	ret[#ret + 1] = domain
+	ret[#ret + 1] = redis.call("HGETALL", ARGV[1] .. domain)
+end
+return ret
+`
+	scriptHashLoad = redis.NewScript(scriptHashLoadSrc)
+)
+
+// DomainName returns the name of the hash holding the cookies of the eTLD+1
+// domain in the HashCookieStore with the given key.
+func DomainName(key, domain string) string {
+	return fmt.Sprintf("%s:d:%s", key, domain)
+}
+
+// HashCookieStore is an EntryStorage that keeps one Redis hash per eTLD+1,
+// mapping cookie ids to their JSON encoded entries. The set of domains with
+// cookies is kept under StoreName(key).
+//
+// Save only writes the cookies that changed since the last Load or Save of
+// the store, so saves are incremental, and concurrent writers that modify
+// different cookies never overwrite each other. A cookie that was modified by
+// both is left as written by the last of them.
+type HashCookieStore struct {
+	redis        redis.UniversalClient
+	id           string
+	storeKey     string
+	invalidateCh chan struct{}
+	opts         *options
+	listener     *listener
+
+	// mu serializes Load and Save with the handling of invalidation
+	// messages, and locks cache and baseline.
+	mu    sync.Mutex
+	cache revCache
+
+	// baseline holds the entries the jar last loaded or saved, which Save
+	// computes changes against. It differs from the entries of cache once a
+	// delta the jar has not reloaded yet is applied to them.
+	baseline encodedEntries
+}
+
+func NewHashCookieStore(redis redis.UniversalClient, storePrefix string, opts ...Option) *HashCookieStore {
+	options := newOptions(opts)
+	store := &HashCookieStore{
+		redis:        redis,
+		id:           newStoreID(),
+		storeKey:     options.key(storePrefix),
+		invalidateCh: make(chan struct{}, 1),
+		opts:         options,
+		cache:        newRevCache(),
+		baseline:     make(encodedEntries),
+		listener:     newListener(),
+	}
+
+	if store.opts.StreamInvalidation {
+		go store.listener.listenStream(store.redis, store.storeKey, store.handleInvalidation, store.resync)
+	} else {
+		go store.listener.listenPubSub(store.redis, store.storeKey, store.handleInvalidation, store.resync, store.reload)
+	}
+
+	return store
+}
+
+// State returns the state of the connection the store receives
+// invalidations on, and the error that caused the last reconnect, if any.
+func (h *HashCookieStore) State() (ConnState, error) {
+	return h.listener.State()
+}
+
+// Close stops receiving invalidations. The store can still be loaded and
+// saved.
+func (h *HashCookieStore) Close() error {
+	return h.listener.Close()
+}
+
+// reload makes the jar reload from the store.
+func (h *HashCookieStore) reload() {
+	h.mu.Lock()
+	h.cache.stale = true
+	h.mu.Unlock()
+
+	invalidate(h.invalidateCh)
+}
+
+func (h *HashCookieStore) handleInvalidation(payload string) {
+	h.mu.Lock()
+	reload := h.cache.handle(payload, h.id)
+	h.mu.Unlock()
+
+	if reload {
+		invalidate(h.invalidateCh)
+	}
+}
+
+// resync reloads if the store has revisions that were not seen.
+func (h *HashCookieStore) resync() error {
+	rev, err := storeRev(h.redis, h.storeKey)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	reload := h.cache.resync(rev)
+	h.mu.Unlock()
+
+	if reload {
+		invalidate(h.invalidateCh)
+	}
+	return nil
+}
+
+func (h *HashCookieStore) InvalidationEvents() <-chan struct{} {
+	return h.invalidateCh
+}
+
+// Load returns the entries of the store. When it is called to reload after a
+// delta published with an invalidation message was applied to the local copy
+// of the entries, that copy is returned without reading the store.
+func (h *HashCookieStore) Load() (cookiejar2.CookieEntries, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if encoded, ok := h.cache.take(); ok {
+		entries, err := encoded.decode()
+		if err != nil {
+			return nil, err
+		}
+		h.baseline = encoded.clone()
+		return entries, nil
+	}
+
+	encoded, rev, err := h.load()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := encoded.decode()
+	if err != nil {
+		return nil, err
+	}
+
+	h.cache.set(rev, encoded)
+	h.baseline = encoded.clone()
+	return entries, nil
+}
+
+// load reads the encoded entries of the store and its revision.
+func (h *HashCookieStore) load() (encodedEntries, int64, error) {
+	return loadHash(h.redis, h.storeKey)
+}
+
+// loadHash reads the encoded entries of the hash store with the given key,
+// and its revision.
+func loadHash(client redis.UniversalClient, key string) (encodedEntries, int64, error) {
+	keys := []string{StoreName(key), MetaName(key)}
+	res, err := scriptHashLoad.Run(client, keys, DomainName(key, "")).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	flat, ok := res.([]interface{})
+	if !ok || len(flat)%2 != 1 {
+		return nil, 0, fmt.Errorf("rediscookiestore: unexpected load result %T", res)
+	}
+
+	encoded := make(encodedEntries)
+	for i := 1; i < len(flat); i += 2 {
+		domain, _ := flat[i].(string)
+		fields, _ := flat[i+1].([]interface{})
+		if len(fields) == 0 {
+			continue
+		}
+
+		submap := make(map[string]string, len(fields)/2)
+		for j := 0; j+1 < len(fields); j += 2 {
+			id, _ := fields[j].(string)
+			val, _ := fields[j+1].(string)
+			submap[id] = val
+		}
+		encoded[domain] = submap
+	}
+
+	return encoded, parseRev(flat[0]), nil
+}
+
+// Save writes the changes since the last Load or Save. Without changes, it
+// only refreshes the expiry of the keys of a store saved WithKeyExpiry.
+func (h *HashCookieStore) Save(entries cookiejar2.CookieEntries) error {
+	next, err := encodeEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ttl := h.opts.keyTTL(entries, time.Now())
+	changes := h.baseline.diff(next)
+	if len(changes) == 0 {
+		if ttl == 0 {
+			return nil
+		}
+		keys := []string{StoreName(h.storeKey), MetaName(h.storeKey), StreamName(h.storeKey)}
+		return scriptHashTouch.Run(h.redis, keys, ttl, DomainName(h.storeKey, "")).Err()
+	}
+
+	keys := []string{StoreName(h.storeKey), InvalidationName(h.storeKey), MetaName(h.storeKey), StreamName(h.storeKey), LeaseName(h.storeKey)}
+	for _, c := range changes {
+		keys = append(keys, DomainName(h.storeKey, c.Domain))
+	}
+
+	arg, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	base := h.cache.base()
+	rev, err := scriptHashSave.Run(h.redis, keys, h.id, arg, base, h.opts.StreamMaxLen, h.opts.Lease.fence(),
+		unixMillis(time.Now()), ttl, DomainName(h.storeKey, "")).Int64()
+	if err != nil {
+		return fenced(err)
+	}
+
+	h.baseline = next
+
+	if base >= 0 && rev == base+1 {
+		h.cache.entries.apply(changes)
+		h.cache.set(rev, h.cache.entries)
+		if h.cache.entries.equal(next) {
+			return nil
+		}
+		// The store holds changes the jar has not loaded yet.
+		invalidate(h.invalidateCh)
+		return nil
+	}
+
+	// The local copy was stale, or other writers saved in between, so the
+	// store may hold changes that were merged with ours. Read it back: if it
+	// matches, later saves can publish deltas again. Otherwise the jar must
+	// reload, and until then next remains the baseline, so that the jar's
+	// next save does not delete the cookies it has not seen yet.
+	h.cache.stale = true
+
+	current, currentRev, err := h.load()
+	if err != nil {
+		// The save succeeded; the next Load will resync.
+		return nil
+	}
+	if current.equal(next) {
+		h.cache.set(currentRev, current)
+	} else {
+		invalidate(h.invalidateCh)
+	}
+	return nil
+}
+
+var _ cookiejar2.EntryStorage = (*HashCookieStore)(nil)
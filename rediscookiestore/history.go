@@ -0,0 +1,164 @@
+package rediscookiestore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/rmdashrf/go-misc/cookiejar2"
+)
+
+// HistoryName returns the name of the list holding the versions of the store
+// with the given key kept by WithHistory, newest first. Each element is a
+// JSON header with the writer, revision and time of the save, followed by a
+// newline and the contents it wrote.
+func HistoryName(key string) string {
+	return fmt.Sprintf("%s:history", key)
+}
+
+// Version is the contents of a store as written by one save.
+type Version struct {
+	// Rev is the revision of the store after the save, and Time when it
+	// happened.
+	Rev  int64
+	Time time.Time
+
+	// Writer is the id of the store that saved, or "restore:<rev>" for
+	// versions written by Restore. It is empty for the current contents of
+	// a store that were not saved with WithHistory.
+	Writer string
+
+	// Contents are the serialized entries, which may be encrypted.
+	Contents []byte
+}
+
+// Entries returns the entries of the version.
+func (v Version) Entries() (cookiejar2.CookieEntries, error) {
+	if len(v.Contents) == 0 {
+		return make(cookiejar2.CookieEntries), nil
+	}
+	return cookiejar2.UnmarshalEntries(v.Contents)
+}
+
+type versionHeader struct {
+	Writer string `json:"writer"`
+	Rev    int64  `json:"rev"`
+	Time   int64  `json:"time"`
+}
+
+func parseVersion(s string) (Version, error) {
+	i := strings.IndexByte(s, '\n')
+	if i == -1 {
+		return Version{}, errors.New("rediscookiestore: version without header")
+	}
+
+	var h versionHeader
+	if err := json.Unmarshal([]byte(s[:i]), &h); err != nil {
+		return Version{}, fmt.Errorf("rediscookiestore: version header: %v", err)
+	}
+	return Version{
+		Rev:      h.Rev,
+		Time:     fromUnixMillis(h.Time),
+		Writer:   h.Writer,
+		Contents: []byte(s[i+1:]),
+	}, nil
+}
+
+// History returns the versions kept of the store with the given key, newest
+// first. The newest is the current contents, unless the store was last saved
+// without WithHistory.
+func History(client redis.UniversalClient, key string) ([]Version, error) {
+	vals, err := client.LRange(HistoryName(key), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]Version, 0, len(vals))
+	for _, val := range vals {
+		v, err := parseVersion(val)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+// LoadVersion returns the version of the store with the given key at revision
+// rev, or its current contents if rev is 0. It returns redis.Nil if the
+// version is not kept, or the store does not exist.
+func LoadVersion(client redis.UniversalClient, key string, rev int64) (Version, error) {
+	if rev == 0 {
+		return currentVersion(client, key)
+	}
+
+	versions, err := History(client, key)
+	if err != nil {
+		return Version{}, err
+	}
+	for _, v := range versions {
+		if v.Rev == rev {
+			return v, nil
+		}
+	}
+	return Version{}, redis.Nil
+}
+
+// currentVersion returns the current contents of the store, with the writer
+// of the newest version in its history if that is the current revision.
+func currentVersion(client redis.UniversalClient, key string) (Version, error) {
+	contents, rev, err := getBlob(client, key)
+	if err != nil {
+		return Version{}, err
+	}
+	if contents == nil && rev == 0 {
+		return Version{}, redis.Nil
+	}
+
+	v := Version{Rev: rev, Contents: contents}
+	if written, err := client.HGet(MetaName(key), "written").Int64(); err == nil {
+		v.Time = fromUnixMillis(written)
+	}
+	if newest, err := client.LIndex(HistoryName(key), 0).Result(); err == nil {
+		if h, err := parseVersion(newest); err == nil && h.Rev == rev {
+			v.Writer = h.Writer
+		}
+	}
+	return v, nil
+}
+
+// DiffVersions returns the changes that turn the entries of old into those of
+// new.
+func DiffVersions(old, new Version) (cookiejar2.Diff, error) {
+	oldEntries, err := old.Entries()
+	if err != nil {
+		return nil, fmt.Errorf("rediscookiestore: revision %d: %v", old.Rev, err)
+	}
+	newEntries, err := new.Entries()
+	if err != nil {
+		return nil, fmt.Errorf("rediscookiestore: revision %d: %v", new.Rev, err)
+	}
+	return cookiejar2.DiffEntries(oldEntries, newEntries), nil
+}
+
+// Restore saves the version of the store with the given key at revision rev
+// as its current contents, and returns the new revision. Like any save, it
+// publishes an invalidation, without a delta, so that the jars using the
+// store reload. opts should be those of the stores, so that the restore is
+// recorded in their history and the keys keep their expiry; with WithLease,
+// it returns ErrFenced unless the lease is held.
+func Restore(client redis.UniversalClient, key string, rev int64, opts ...Option) (int64, error) {
+	v, err := LoadVersion(client, key, rev)
+	if err != nil {
+		return 0, err
+	}
+
+	options := newOptions(opts)
+	// The expiries of encrypted entries are unknown, as with SaveBlob.
+	entries, _ := v.Entries()
+	writer := fmt.Sprintf("restore:%d", v.Rev)
+	return setBlob(client, key, v.Contents, writer, -1, nil, options, options.keyTTL(entries, time.Now()))
+}
@@ -0,0 +1,105 @@
+package rediscookiestore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/rmdashrf/go-misc/cookiejar2"
+	"github.com/rmdashrf/go-misc/cookiejar2/storagetest"
+)
+
+func TestHistory(t *testing.T) {
+	cl, newKey := testClient(t)
+
+	key := newKey("testHistory")
+	writer := NewRedisCookieStore(cl, key, WithHistory(2))
+	defer writer.Close()
+	reader := NewRedisCookieStore(cl, key)
+	defer reader.Close()
+
+	entries := storagetest.Entries()
+	saves := []cookiejar2.CookieEntries{entries, make(cookiejar2.CookieEntries), entries}
+	for _, e := range saves {
+		if err := writer.Save(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the last two saves are kept, newest first.
+	versions, err := History(cl, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Rev != 3 || versions[1].Rev != 2 {
+		t.Fatalf("history = %+v, want revisions 3 and 2", versions)
+	}
+	for _, v := range versions {
+		if v.Writer != writer.id || time.Since(v.Time) > time.Minute {
+			t.Errorf("revision %d written by %q at %v", v.Rev, v.Writer, v.Time)
+		}
+	}
+	if _, err := LoadVersion(cl, key, 1); err != redis.Nil {
+		t.Errorf("LoadVersion of trimmed revision = %v, want redis.Nil", err)
+	}
+	current, err := LoadVersion(cl, key, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Rev != 3 || current.Writer != writer.id || string(current.Contents) != string(versions[0].Contents) {
+		t.Errorf("current version = %+v", current)
+	}
+
+	d, err := DiffVersions(versions[1], current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d) != 3 {
+		t.Errorf("diff = %v, want 3 cookies added", d)
+	}
+	for _, c := range d {
+		if c.Kind != cookiejar2.Added {
+			t.Errorf("change %v of %s, want added", c.Kind, c.ID)
+		}
+	}
+
+	// Restoring publishes an invalidation, and is recorded as a new
+	// revision.
+	if _, err := reader.Load(); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, reader.State, StateConnected)
+	rev, err := Restore(cl, key, 2, WithHistory(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev != 4 {
+		t.Errorf("restored as revision %d, want 4", rev)
+	}
+	select {
+	case <-reader.InvalidationEvents():
+	case <-time.After(time.Second):
+		t.Fatal("no invalidation")
+	}
+	if restored, err := reader.Load(); err != nil || len(restored) != 0 {
+		t.Errorf("entries after restore = %v, %v, want none", restored, err)
+	}
+	versions, err = History(cl, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Rev != 4 || versions[0].Writer != "restore:2" {
+		t.Errorf("history after restore = %+v", versions)
+	}
+
+	if _, err := Restore(cl, key, 1); err != redis.Nil {
+		t.Errorf("Restore of trimmed revision = %v, want redis.Nil", err)
+	}
+
+	if ok, err := DeleteStore(cl, key); !ok || err != nil {
+		t.Fatalf("DeleteStore = %v, %v", ok, err)
+	}
+	if n, _ := cl.Exists(HistoryName(key)).Result(); n != 0 {
+		t.Error("history remains after DeleteStore")
+	}
+}
@@ -0,0 +1,242 @@
+package rediscookiestore
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+var (
+	// ErrLeaseHeld is returned by AcquireLease when another owner holds the
+	// lease.
+	ErrLeaseHeld = errors.New("rediscookiestore: lease held by another owner")
+
+	// ErrLeaseLost is returned by Lease.Err when the lease expired or was
+	// taken over before it was released.
+	ErrLeaseLost = errors.New("rediscookiestore: lease lost")
+
+	// ErrFenced is returned by the saves of a store whose lease is no longer
+	// held. The store was not modified.
+	ErrFenced = errors.New("rediscookiestore: save fenced off, lease not held")
+)
+
+var (
+	// LEASEACQUIRE <leasekey> <metakey> <ttl> <now>
+	// sets <leasekey> to a new fencing token, taken from the "fence" field of
+	// <metakey>, and expires it in <ttl> milliseconds, unless it is already
+	// set. The tokens start from <now>, so that they are not reused when
+	// <metakey> expired with the store. Returns the token, or 0 if the lease
+	// is held.
+	scriptLeaseAcquireSrc = `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+if redis.call("HEXISTS", KEYS[2], "fence") == 0 then
+	redis.call("HSET", KEYS[2], "fence", ARGV[2])
+end
+local token = redis.call("HINCRBY", KEYS[2], "fence", 1)
+redis.call("SET", KEYS[1], token, "PX", ARGV[1])
+return token
+`
+	scriptLeaseAcquire = redis.NewScript(scriptLeaseAcquireSrc)
+
+	// LEASERENEW <leasekey> <token> <ttl>
+	// expires <leasekey> in <ttl> milliseconds if it holds <token>. Returns
+	// 1 if it did, 0 otherwise.
+	scriptLeaseRenewSrc = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`
+	scriptLeaseRenew = redis.NewScript(scriptLeaseRenewSrc)
+
+	// LEASERELEASE <leasekey> <token>
+	// deletes <leasekey> if it holds <token>. Returns 1 if it did, 0
+	// otherwise.
+	scriptLeaseReleaseSrc = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`
+	scriptLeaseRelease = redis.NewScript(scriptLeaseReleaseSrc)
+)
+
+// fencedPrefix starts the error replies of the save scripts when the lease
+// key does not hold the fencing token they were given.
+const fencedPrefix = "FENCED"
+
+// fenced translates the error returned when a save script was fenced off to
+// ErrFenced.
+func fenced(err error) error {
+	if err != nil && strings.HasPrefix(err.Error(), fencedPrefix) {
+		return ErrFenced
+	}
+	return err
+}
+
+// LeaseName returns the name of the key holding the lease on the store with
+// the given key.
+func LeaseName(key string) string {
+	return fmt.Sprintf("%s:lease", key)
+}
+
+// Lease is an exclusive, automatically renewed lease on a store, so that a
+// single worker uses its session at a time.
+//
+// Every acquisition gets a new fencing token. Stores created with WithLease
+// only save while the lease key holds their token, so a worker whose lease
+// expired, for instance because it was paused for longer than the TTL,
+// cannot overwrite the jar of the next owner.
+type Lease struct {
+	redis redis.UniversalClient
+	key   string
+	token int64
+	ttl   time.Duration
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+
+	// onRenew is called after every renewal.
+	onRenew func(ttl time.Duration)
+
+	mu       sync.Mutex
+	err      error
+	released bool
+}
+
+// AcquireLease acquires the lease on the store with the given key, which
+// expires after ttl unless it is renewed. The lease is renewed every third
+// of ttl until it is released. ErrLeaseHeld is returned if another owner
+// holds the lease.
+func AcquireLease(client redis.UniversalClient, key string, ttl time.Duration) (*Lease, error) {
+	return acquireLease(client, key, ttl, nil)
+}
+
+// acquireLease is AcquireLease with a function called after every renewal.
+func acquireLease(client redis.UniversalClient, key string, ttl time.Duration, onRenew func(ttl time.Duration)) (*Lease, error) {
+	keys := []string{LeaseName(key), MetaName(key)}
+	token, err := scriptLeaseAcquire.Run(client, keys, ttl.Milliseconds(), unixMillis(time.Now())).Int64()
+	if err != nil {
+		return nil, err
+	}
+	if token == 0 {
+		return nil, ErrLeaseHeld
+	}
+
+	l := &Lease{
+		redis:   client,
+		key:     key,
+		token:   token,
+		ttl:     ttl,
+		onRenew: onRenew,
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	go l.renew()
+
+	return l, nil
+}
+
+// Token returns the fencing token of the lease.
+func (l *Lease) Token() int64 {
+	return l.token
+}
+
+// Done returns a channel that is closed when the lease is released or lost.
+func (l *Lease) Done() <-chan struct{} {
+	return l.doneCh
+}
+
+// Err returns ErrLeaseLost once Done is closed because the lease was lost,
+// and nil otherwise.
+func (l *Lease) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// renew renews the lease until it is released, or until it could not be
+// renewed before expiring.
+func (l *Lease) renew() {
+	defer close(l.doneCh)
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-l.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		ok, err := scriptLeaseRenew.Run(l.redis, []string{LeaseName(l.key)}, l.token, l.ttl.Milliseconds()).Int64()
+		switch {
+		case err != nil && time.Since(renewed) < l.ttl:
+			log.Printf("Failed to renew lease on %s: %v\n", l.key, err)
+			continue
+		case err == nil && ok == 1:
+			renewed = time.Now()
+			if l.onRenew != nil {
+				l.onRenew(l.ttl)
+			}
+			continue
+		}
+
+		l.mu.Lock()
+		if !l.released {
+			l.err = ErrLeaseLost
+		}
+		l.mu.Unlock()
+		return
+	}
+}
+
+// Release stops renewing the lease and releases it, so that the next owner
+// does not have to wait for it to expire. It returns ErrLeaseLost if the
+// lease was lost before.
+func (l *Lease) Release() error {
+	l.mu.Lock()
+	if l.released {
+		l.mu.Unlock()
+		return nil
+	}
+	l.released = true
+	l.mu.Unlock()
+
+	close(l.stopCh)
+	<-l.doneCh
+
+	if err := l.Err(); err != nil {
+		return err
+	}
+	ok, err := scriptLeaseRelease.Run(l.redis, []string{LeaseName(l.key)}, l.token).Int64()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		l.mu.Lock()
+		l.err = ErrLeaseLost
+		l.mu.Unlock()
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// fence returns the fencing token of the lease as a script argument, or an
+// empty string if there is no lease.
+func (l *Lease) fence() string {
+	if l == nil {
+		return ""
+	}
+	return strconv.FormatInt(l.token, 10)
+}
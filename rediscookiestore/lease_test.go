@@ -0,0 +1,89 @@
+package rediscookiestore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rmdashrf/go-misc/cookiejar2/storagetest"
+)
+
+func TestLease(t *testing.T) {
+	cl, newKey := testClient(t)
+
+	tmpname := newKey("testLease")
+	const ttl = 300 * time.Millisecond
+
+	first, err := AcquireLease(cl, tmpname, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AcquireLease(cl, tmpname, ttl); err != ErrLeaseHeld {
+		t.Fatalf("second AcquireLease = %v, want ErrLeaseHeld", err)
+	}
+
+	// The lease is renewed past its TTL.
+	time.Sleep(3 * ttl)
+	if held, err := cl.Exists(LeaseName(tmpname)).Result(); err != nil || held != 1 {
+		t.Fatalf("lease not renewed: %v", err)
+	}
+
+	store := NewHashCookieStore(cl, tmpname, WithLease(first))
+	defer store.Close()
+	if err := store.Save(storagetest.Entries()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate the lease expiring while its owner was paused, and another
+	// worker taking over.
+	cl.Del(LeaseName(tmpname))
+	second, err := AcquireLease(cl, tmpname, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Token() <= first.Token() {
+		t.Errorf("token %d does not follow %d", second.Token(), first.Token())
+	}
+
+	stale := NewRedisCookieStore(cl, tmpname, WithLease(first))
+	defer stale.Close()
+	if err := stale.Save(nil); err != ErrFenced {
+		t.Errorf("blob Save with lost lease = %v, want ErrFenced", err)
+	}
+	if err := store.Save(nil); err != ErrFenced {
+		t.Errorf("hash Save with lost lease = %v, want ErrFenced", err)
+	}
+	entries, err := NewHashCookieStore(cl, tmpname).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !storagetest.Equal(entries, storagetest.Entries()) {
+		t.Error("fenced save modified the store")
+	}
+
+	select {
+	case <-first.Done():
+	case <-time.After(time.Second):
+		t.Fatal("lost lease not detected")
+	}
+	if err := first.Err(); err != ErrLeaseLost {
+		t.Errorf("Err = %v, want ErrLeaseLost", err)
+	}
+	if err := first.Release(); err != ErrLeaseLost {
+		t.Errorf("Release of lost lease = %v, want ErrLeaseLost", err)
+	}
+
+	// Releasing lets the next owner acquire the lease right away.
+	if err := second.Release(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-second.Done():
+	default:
+		t.Error("Done not closed by Release")
+	}
+	third, err := AcquireLease(cl, tmpname, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third.Release()
+}
@@ -0,0 +1,246 @@
+package rediscookiestore
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// ConnState is the state of the connection a store receives invalidations
+// on.
+type ConnState int
+
+const (
+	// StateConnecting is the state of a store until it first subscribes.
+	StateConnecting ConnState = iota
+
+	// StateConnected means the store receives invalidations.
+	StateConnected
+
+	// StateReconnecting means the connection failed, and the store is
+	// waiting to retry. Invalidations published in the meantime are covered
+	// by a reload once it reconnects.
+	StateReconnecting
+
+	// StateClosed means the store was closed.
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// ErrClosed is returned by the operations of a closed listener.
+var ErrClosed = errors.New("rediscookiestore: closed")
+
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 30 * time.Second
+
+	// pingInterval is how long the pubsub listener waits for a message
+	// before checking the connection with a ping.
+	pingInterval = 30 * time.Second
+)
+
+// listener tracks the connection state of the goroutine receiving the
+// invalidations of a store, and stops it on close.
+type listener struct {
+	mu      sync.Mutex
+	state   ConnState
+	lastErr error
+	closer  func() error
+
+	closeCh chan struct{}
+	doneCh  chan struct{}
+}
+
+func newListener() *listener {
+	return &listener{
+		closeCh: make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+}
+
+// State returns the connection state, and the error that caused the last
+// reconnect, if any.
+func (l *listener) State() (ConnState, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state, l.lastErr
+}
+
+func (l *listener) connected() {
+	l.mu.Lock()
+	l.state = StateConnected
+	l.mu.Unlock()
+}
+
+func (l *listener) failed(err error) {
+	l.mu.Lock()
+	if l.state != StateClosed {
+		l.state = StateReconnecting
+		l.lastErr = err
+	}
+	l.mu.Unlock()
+}
+
+// setCloser registers the function that interrupts the blocking read in
+// progress. It reports false if the listener was closed, in which case close
+// is called right away.
+func (l *listener) setCloser(close func() error) bool {
+	l.mu.Lock()
+	if l.state == StateClosed {
+		l.mu.Unlock()
+		close()
+		return false
+	}
+	l.closer = close
+	l.mu.Unlock()
+	return true
+}
+
+// Close stops the listener and waits for it to return.
+func (l *listener) Close() error {
+	l.mu.Lock()
+	if l.state == StateClosed {
+		l.mu.Unlock()
+		return ErrClosed
+	}
+	l.state = StateClosed
+	close(l.closeCh)
+	closer := l.closer
+	l.mu.Unlock()
+
+	if closer != nil {
+		closer()
+	}
+	<-l.doneCh
+	return nil
+}
+
+func (l *listener) closed() bool {
+	select {
+	case <-l.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for d, and reports false if the listener was closed first.
+func (l *listener) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-l.closeCh:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// nextBackoff doubles d, up to maxBackoff.
+func nextBackoff(d time.Duration) time.Duration {
+	if d *= 2; d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// listenPubSub calls handle with the payload of every invalidation message
+// published for key, until the listener is closed.
+//
+// When the subscription fails, it is closed and retried with exponential
+// backoff. Messages published while the store is not subscribed are lost, so
+// reload is called after every resubscription, and resync, which reloads if
+// the store was saved since it was loaded, after the first subscription. If
+// resync fails, reload is called instead.
+func (l *listener) listenPubSub(client redis.UniversalClient, key string, handle func(payload string), resync func() error, reload func()) {
+	defer close(l.doneCh)
+
+	invName := InvalidationName(key)
+	backoff := minBackoff
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if !l.sleep(backoff) {
+				return
+			}
+			backoff = nextBackoff(backoff)
+		}
+
+		pubsub := client.Subscribe()
+		if !l.setCloser(pubsub.Close) {
+			return
+		}
+
+		err := l.receive(pubsub, invName, func() {
+			backoff = minBackoff
+			if attempt > 0 {
+				reload()
+			} else if err := resync(); err != nil {
+				log.Printf("Failed to resync %s: %v\n", key, err)
+				reload()
+			}
+		}, handle)
+		pubsub.Close()
+
+		if l.closed() {
+			return
+		}
+		log.Printf("Failed to receive invalidations on %s: %v\n", invName, err)
+		l.failed(err)
+	}
+}
+
+// receive subscribes pubsub to channel, calls subscribed once the
+// subscription is confirmed, before reporting the listener as connected, and
+// then handle with every message, until an
+// error occurs. A connection that neither delivers messages nor answers a
+// ping within pingInterval is considered broken.
+func (l *listener) receive(pubsub *redis.PubSub, channel string, subscribed func(), handle func(payload string)) error {
+	if err := pubsub.Subscribe(channel); err != nil {
+		return err
+	}
+
+	pinged := false
+	for {
+		msg, err := pubsub.ReceiveTimeout(pingInterval)
+		if err != nil {
+			if e, ok := err.(net.Error); !ok || !e.Timeout() || pinged {
+				return err
+			}
+			if err := pubsub.Ping(); err != nil {
+				return err
+			}
+			pinged = true
+			continue
+		}
+		pinged = false
+
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			if msg.Kind == "subscribe" {
+				subscribed()
+				l.connected()
+			}
+		case *redis.Message:
+			handle(msg.Payload)
+		}
+	}
+}
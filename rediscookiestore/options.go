@@ -0,0 +1,132 @@
+package rediscookiestore
+
+import (
+	"time"
+
+	"github.com/rmdashrf/go-misc/cookiejar2"
+)
+
+// DefaultStreamMaxLen is the default approximate length at which the
+// invalidation stream of a store is trimmed.
+const DefaultStreamMaxLen = 1000
+
+type options struct {
+	StreamInvalidation bool
+	StreamMaxLen       int64
+	HashTag            bool
+	Lease              *Lease
+	ExpiryGrace        time.Duration
+	IdleTTL            time.Duration
+	History            int64
+}
+
+type Option func(*options)
+
+// StreamInvalidation makes the store receive invalidations from the stream
+// StreamName(key) instead of pubsub. Unlike pubsub, invalidations saved while
+// the store is disconnected are not lost: the store catches up from the last
+// entry it has seen, and reloads if the stream was trimmed past it.
+func StreamInvalidation(opt *options) {
+	opt.StreamInvalidation = true
+}
+
+// WithStreamMaxLen sets the approximate length at which the store trims the
+// invalidation stream when it saves. Stores that fall further behind than
+// that reload all entries. A length of 0 disables writing to the stream,
+// for deployments where every store uses pubsub.
+func WithStreamMaxLen(n int64) Option {
+	return func(opt *options) {
+		opt.StreamMaxLen = n
+	}
+}
+
+// HashTag makes the store use HashTagged(prefix) as its key, so that all of
+// its keys hash to the same Redis Cluster slot, as required by the scripts
+// that update them. Other clients of the store, such as SetCookies, must be
+// given the tagged key.
+func HashTag(opt *options) {
+	opt.HashTag = true
+}
+
+// WithLease makes the store save only while lease is held; saves return
+// ErrFenced once it was lost. The lease must have been acquired on the key of
+// the store.
+func WithLease(lease *Lease) Option {
+	return func(opt *options) {
+		opt.Lease = lease
+	}
+}
+
+// WithKeyExpiry makes the keys of the store expire on their own once its
+// cookies have: grace after the latest expiry of a persistent cookie, as of
+// the last save. Stores without unexpired persistent cookies expire idle
+// after the last save, unless idle is 0. Every save refreshes the expiry.
+//
+// The metadata hash MetaName(key) expires with the other keys. As jars and
+// leases may outlive it, its revisions start from the time of the next save
+// in milliseconds, rather than over from 1, and so do fencing tokens.
+func WithKeyExpiry(grace, idle time.Duration) Option {
+	return func(opt *options) {
+		opt.ExpiryGrace = grace
+		opt.IdleTTL = idle
+	}
+}
+
+// WithHistory makes the store keep the contents written by its last n saves
+// in HistoryName(key), so that they can be inspected with History and
+// LoadVersion and brought back with Restore. Only RedisCookieStore keeps a
+// history, and only saves by stores with this option are recorded. A
+// history of 0 disables it.
+func WithHistory(n int64) Option {
+	return func(opt *options) {
+		opt.History = n
+	}
+}
+
+// keyTTL returns the TTL in milliseconds of the keys of a store holding
+// entries, saved at now, -1 if they should not expire, or 0 if their expiry
+// is not managed by the store.
+func (o *options) keyTTL(entries cookiejar2.CookieEntries, now time.Time) int64 {
+	if o.ExpiryGrace <= 0 && o.IdleTTL <= 0 {
+		return 0
+	}
+
+	var latest time.Time
+	for _, submap := range entries {
+		for _, e := range submap {
+			if e.Persistent && e.Expires.After(latest) {
+				latest = e.Expires
+			}
+		}
+	}
+
+	ttl := o.IdleTTL
+	if latest.After(now) {
+		ttl = latest.Add(o.ExpiryGrace).Sub(now)
+	}
+	if ttl <= 0 {
+		return -1
+	}
+	if ttl < time.Millisecond {
+		return 1
+	}
+	return int64(ttl / time.Millisecond)
+}
+
+// key returns the key of a store with the given prefix.
+func (o *options) key(prefix string) string {
+	if o.HashTag {
+		return HashTagged(prefix)
+	}
+	return prefix
+}
+
+func newOptions(opts []Option) *options {
+	options := &options{
+		StreamMaxLen: DefaultStreamMaxLen,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
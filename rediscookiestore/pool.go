@@ -0,0 +1,398 @@
+package rediscookiestore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/rmdashrf/go-misc/cookiejar2"
+)
+
+var (
+	// ErrPoolExhausted is returned by Checkout when no identity is idle.
+	ErrPoolExhausted = errors.New("rediscookiestore: no idle identity in pool")
+
+	// ErrNotCheckedOut is returned when returning an identity whose checkout
+	// expired, or that was removed from the pool.
+	ErrNotCheckedOut = errors.New("rediscookiestore: identity no longer checked out")
+)
+
+var (
+	// POOLCHECKOUT <idle> <busy> <owners> <now> <deadline> <owner>
+	// first moves the identities of <busy> whose checkout expired before
+	// <now> back to <idle>. It then moves the identity of <idle> that has
+	// been available for the longest, if any became available by <now>, to
+	// <busy> until <deadline>, and records <owner> as its owner in <owners>.
+	// Returns the identity, or nil if none is available.
+	scriptPoolCheckoutSrc = `
+local idle, busy, owners = KEYS[1], KEYS[2], KEYS[3]
+local now = ARGV[1]
+
+for _, key in ipairs(redis.call("ZRANGEBYSCORE", busy, "-inf", "(" .. now)) do
+	redis.call("ZREM", busy, key)
+	redis.call("HDEL", owners, key)
+	redis.call("ZADD", idle, now, key)
+end
+
+local key = redis.call("ZRANGEBYSCORE", idle, "-inf", now, "LIMIT", 0, 1)[1]
+if not key then
+	return nil
+end
+redis.call("ZREM", idle, key)
+redis.call("ZADD", busy, ARGV[2], key)
+redis.call("HSET", owners, key, ARGV[3])
+return key
+`
+	scriptPoolCheckout = redis.NewScript(scriptPoolCheckoutSrc)
+
+	// POOLTOUCH <busy> <owners> <key> <owner> <deadline>
+	// extends the checkout of <key> to <deadline> if <owner> holds it.
+	// Returns 1 if it did, 0 otherwise.
+	scriptPoolTouchSrc = `
+if redis.call("HGET", KEYS[2], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call("ZADD", KEYS[1], "XX", ARGV[3], ARGV[1])
+return 1
+`
+	scriptPoolTouch = redis.NewScript(scriptPoolTouchSrc)
+
+	// POOLRETURN <idle> <busy> <owners> <unhealthy> <key> <owner> <available> <health>
+	// ends the checkout of <key> if <owner> holds it. If <health> is empty,
+	// <key> becomes idle again at <available>; otherwise <key> is set to
+	// <health> in <unhealthy>. Returns 1 if <owner> held the checkout, 0
+	// otherwise.
+	scriptPoolReturnSrc = `
+local idle, busy, owners, unhealthy = KEYS[1], KEYS[2], KEYS[3], KEYS[4]
+local key = ARGV[1]
+
+if redis.call("HGET", owners, key) ~= ARGV[2] then
+	return 0
+end
+redis.call("ZREM", busy, key)
+redis.call("HDEL", owners, key)
+if ARGV[4] == "" then
+	redis.call("ZADD", idle, ARGV[3], key)
+else
+	redis.call("HSET", unhealthy, key, ARGV[4])
+end
+return 1
+`
+	scriptPoolReturn = redis.NewScript(scriptPoolReturnSrc)
+
+	// POOLADD <idle> <busy> <unhealthy> <key>...
+	// adds each <key> that is not in the pool yet to <idle>, available
+	// immediately. Returns the number of identities added.
+	scriptPoolAddSrc = `
+local idle, busy, unhealthy = KEYS[1], KEYS[2], KEYS[3]
+local added = 0
+for _, key in ipairs(ARGV) do
+	if not redis.call("ZSCORE", busy, key) and redis.call("HEXISTS", unhealthy, key) == 0 then
+		added = added + redis.call("ZADD", idle, "NX", 0, key)
+	end
+end
+return added
+`
+	scriptPoolAdd = redis.NewScript(scriptPoolAddSrc)
+
+	// POOLREMOVE <idle> <busy> <owners> <unhealthy> <key>...
+	// removes each <key> from the pool, in whatever state it is.
+	scriptPoolRemoveSrc = `
+for _, key in ipairs(ARGV) do
+	redis.call("ZREM", KEYS[1], key)
+	redis.call("ZREM", KEYS[2], key)
+	redis.call("HDEL", KEYS[3], key)
+	redis.call("HDEL", KEYS[4], key)
+end
+return 0
+`
+	scriptPoolRemove = redis.NewScript(scriptPoolRemoveSrc)
+
+	// POOLHEAL <idle> <unhealthy> <key> <now>
+	// makes the unhealthy <key> idle at <now>. Returns 1 if <key> was
+	// unhealthy, 0 otherwise.
+	scriptPoolHealSrc = `
+if redis.call("HDEL", KEYS[2], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
+return 1
+`
+	scriptPoolHeal = redis.NewScript(scriptPoolHealSrc)
+)
+
+// Pool is a pool of identities, each a store with its own key, shared by
+// workers in any number of processes. Its state is kept in Redis under the
+// namespace of the pool, hash tagged with HashTagged:
+//
+//	<ns>:pool:idle       sorted set of idle identities, scored by the time
+//	                     in milliseconds at which their cooldown ends
+//	<ns>:pool:busy       sorted set of checked out identities, scored by
+//	                     the time their checkout expires
+//	<ns>:pool:owners     hash of checked out identities to checkout ids
+//	<ns>:pool:unhealthy  hash of unhealthy identities to their Health as JSON
+//
+// A checked out identity holds the Lease on its store, so that it is never
+// used by two workers at once, even when a worker outlives its checkout.
+type Pool struct {
+	redis redis.UniversalClient
+	ns    string
+
+	// JarOptions are the options of the jars of checked out identities.
+	// Storage and IgnoreInvalidations are set by the pool: as the lease
+	// keeps other writers out, jars do not listen for invalidations.
+	JarOptions cookiejar2.Options
+
+	// StoreOptions are the options of the stores of checked out
+	// identities, in addition to WithLease.
+	StoreOptions []Option
+}
+
+// NewPool returns the pool with the given namespace.
+func NewPool(client redis.UniversalClient, namespace string) *Pool {
+	return &Pool{
+		redis: client,
+		ns:    namespace,
+	}
+}
+
+func (p *Pool) keyName(name string) string {
+	return fmt.Sprintf("%s:pool:%s", HashTagged(p.ns), name)
+}
+
+// Add adds the identities with the given store keys to the pool, idle.
+// Identities already in the pool are left as they are.
+func (p *Pool) Add(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return scriptPoolAdd.Run(p.redis, []string{p.keyName("idle"), p.keyName("busy"), p.keyName("unhealthy")}, stringArgs(keys)...).Err()
+}
+
+// Remove removes the identities with the given store keys from the pool.
+// Checked out identities can no longer be returned.
+func (p *Pool) Remove(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return scriptPoolRemove.Run(p.redis, p.poolKeys(), stringArgs(keys)...).Err()
+}
+
+// poolKeys returns the keys used by POOLRETURN and POOLREMOVE.
+func (p *Pool) poolKeys() []string {
+	return []string{p.keyName("idle"), p.keyName("busy"), p.keyName("owners"), p.keyName("unhealthy")}
+}
+
+func stringArgs(s []string) []interface{} {
+	ret := make([]interface{}, len(s))
+	for i, v := range s {
+		ret[i] = v
+	}
+	return ret
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromUnixMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// maxCheckoutAttempts bounds the identities Checkout tries when their leases
+// are still held.
+const maxCheckoutAttempts = 3
+
+// Checkout checks out the identity that has been idle for the longest, and
+// returns it with its jar loaded. The checkout and the lease on the store of
+// the identity expire after ttl unless renewed, which happens automatically
+// until the identity is returned. ErrPoolExhausted is returned if no
+// identity is idle.
+func (p *Pool) Checkout(ttl time.Duration) (*Identity, error) {
+	for attempt := 0; attempt < maxCheckoutAttempts; attempt++ {
+		owner := newStoreID()
+		now := time.Now()
+		key, err := scriptPoolCheckout.Run(p.redis, []string{p.keyName("idle"), p.keyName("busy"), p.keyName("owners")},
+			unixMillis(now), unixMillis(now.Add(ttl)), owner).String()
+		if err == redis.Nil {
+			return nil, ErrPoolExhausted
+		} else if err != nil {
+			return nil, err
+		}
+
+		// The lease is on the key of the store, which is hash tagged if
+		// the store options ask for it.
+		id := &Identity{Key: key, pool: p, owner: owner}
+		id.Lease, err = acquireLease(p.redis, newOptions(p.StoreOptions).key(key), ttl, id.touch)
+		if err == ErrLeaseHeld {
+			// The previous owner outlived its checkout and still uses the
+			// identity. Leave it alone until its lease would expire.
+			p.finish(key, owner, time.Now().Add(ttl), "")
+			continue
+		} else if err != nil {
+			p.finish(key, owner, time.Now(), "")
+			return nil, err
+		}
+
+		opts := append([]Option{WithLease(id.Lease)}, p.StoreOptions...)
+		id.store = NewRedisCookieStore(p.redis, key, opts...)
+
+		jarOpts := p.JarOptions
+		jarOpts.Storage = id.store
+		jarOpts.IgnoreInvalidations = true
+		if id.Jar, err = cookiejar2.Load(&jarOpts); err != nil {
+			id.release(time.Now(), "")
+			return nil, err
+		}
+		return id, nil
+	}
+	return nil, ErrPoolExhausted
+}
+
+// finish ends the checkout of key by owner, making the identity idle at
+// available, or unhealthy if health is not empty.
+func (p *Pool) finish(key, owner string, available time.Time, health string) error {
+	ok, err := scriptPoolReturn.Run(p.redis, p.poolKeys(), key, owner, unixMillis(available), health).Int64()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrNotCheckedOut
+	}
+	return nil
+}
+
+// Heal makes the unhealthy identity with the given store key idle.
+func (p *Pool) Heal(key string) error {
+	return scriptPoolHeal.Run(p.redis, []string{p.keyName("idle"), p.keyName("unhealthy")}, key, unixMillis(time.Now())).Err()
+}
+
+// Health describes why an identity was marked unhealthy.
+type Health struct {
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+}
+
+// PoolStatus is the state of the identities of a pool.
+type PoolStatus struct {
+	// Idle are the identities that can be checked out, and CoolingDown
+	// those that will be once their cooldown ends, by store key.
+	Idle        []string
+	CoolingDown map[string]time.Time
+
+	// Busy maps checked out identities to the expiry of their checkout.
+	Busy map[string]time.Time
+
+	Unhealthy map[string]Health
+}
+
+// Status returns the state of the identities of the pool.
+func (p *Pool) Status() (PoolStatus, error) {
+	status := PoolStatus{
+		CoolingDown: make(map[string]time.Time),
+		Busy:        make(map[string]time.Time),
+		Unhealthy:   make(map[string]Health),
+	}
+
+	pipe := p.redis.TxPipeline()
+	idle := pipe.ZRangeWithScores(p.keyName("idle"), 0, -1)
+	busy := pipe.ZRangeWithScores(p.keyName("busy"), 0, -1)
+	unhealthy := pipe.HGetAll(p.keyName("unhealthy"))
+	if _, err := pipe.Exec(); err != nil {
+		return status, err
+	}
+
+	now := time.Now()
+	for _, z := range idle.Val() {
+		key, _ := z.Member.(string)
+		if available := fromUnixMillis(int64(z.Score)); available.After(now) {
+			status.CoolingDown[key] = available
+		} else {
+			status.Idle = append(status.Idle, key)
+		}
+	}
+	for _, z := range busy.Val() {
+		key, _ := z.Member.(string)
+		status.Busy[key] = fromUnixMillis(int64(z.Score))
+	}
+	for key, val := range unhealthy.Val() {
+		var h Health
+		if err := json.Unmarshal([]byte(val), &h); err != nil {
+			h.Reason = val
+		}
+		status.Unhealthy[key] = h
+	}
+	sort.Strings(status.Idle)
+
+	return status, nil
+}
+
+// Identity is an identity checked out from a Pool.
+type Identity struct {
+	// Key is the store key of the identity.
+	Key string
+
+	// Jar holds the cookies of the identity, saved to its store.
+	Jar *cookiejar2.Jar
+
+	// Lease is the lease on the store of the identity. Once it is lost, the
+	// jar can no longer be saved, and the identity should not be used.
+	Lease *Lease
+
+	pool     *Pool
+	owner    string
+	store    *RedisCookieStore
+	released bool
+}
+
+// touch extends the checkout along with the lease.
+func (id *Identity) touch(ttl time.Duration) {
+	keys := []string{id.pool.keyName("busy"), id.pool.keyName("owners")}
+	deadline := unixMillis(time.Now().Add(ttl))
+	if err := scriptPoolTouch.Run(id.pool.redis, keys, id.Key, id.owner, deadline).Err(); err != nil {
+		log.Printf("Failed to extend checkout of %s: %v\n", id.Key, err)
+	}
+}
+
+// Return saves the jar and returns the identity to the pool, where it can be
+// checked out again once cooldown has passed.
+func (id *Identity) Return(cooldown time.Duration) error {
+	return id.release(time.Now().Add(cooldown), "")
+}
+
+// MarkUnhealthy saves the jar and returns the identity to the pool as
+// unhealthy, so that it is not checked out until it is healed.
+func (id *Identity) MarkUnhealthy(reason string) error {
+	health, err := json.Marshal(Health{Reason: reason, Since: time.Now()})
+	if err != nil {
+		return err
+	}
+	return id.release(time.Now(), string(health))
+}
+
+// release saves the jar, if any, releases the lease and ends the checkout.
+// The first error is returned.
+func (id *Identity) release(available time.Time, health string) error {
+	if id.released {
+		return ErrNotCheckedOut
+	}
+	id.released = true
+
+	var errs []error
+	if id.Jar != nil {
+		id.Jar.SaveCookies()
+		errs = append(errs, id.Jar.Health().Err())
+	}
+	errs = append(errs, id.store.Close(), id.Lease.Release(), id.pool.finish(id.Key, id.owner, available, health))
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package rediscookiestore
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+func TestPool(t *testing.T) {
+	cl, newKey := testClient(t)
+
+	ns := newKey("testPool")
+	first, second := ns+":first", ns+":second"
+	pool := NewPool(cl, ns)
+	if err := pool.Add(first, second); err != nil {
+		t.Fatal(err)
+	}
+
+	const ttl = 300 * time.Millisecond
+	a, err := pool.Checkout(ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Key != first {
+		t.Errorf("checked out %s, want the first added %s", a.Key, first)
+	}
+	a.Jar.SetCookies(foobarUrl, []*http.Cookie{testCookie1})
+
+	// Checkouts are renewed while in use, and other processes share the
+	// state of the pool.
+	time.Sleep(3 * ttl)
+	b, err := NewPool(cl, ns).Checkout(ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Key != second {
+		t.Errorf("checked out %s, want %s", b.Key, second)
+	}
+	if _, err := pool.Checkout(ttl); err != ErrPoolExhausted {
+		t.Fatalf("Checkout of empty pool = %v, want ErrPoolExhausted", err)
+	}
+
+	if err := a.Return(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.MarkUnhealthy("logged out"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Return(0); err != ErrNotCheckedOut {
+		t.Errorf("second Return = %v, want ErrNotCheckedOut", err)
+	}
+
+	status, err := pool.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Idle) != 0 || len(status.Busy) != 0 {
+		t.Errorf("idle %v, busy %v, want none", status.Idle, status.Busy)
+	}
+	if _, ok := status.CoolingDown[first]; !ok {
+		t.Errorf("%s not cooling down: %+v", first, status)
+	}
+	if h := status.Unhealthy[second]; h.Reason != "logged out" || h.Since.IsZero() {
+		t.Errorf("health of %s = %+v", second, h)
+	}
+	if _, err := pool.Checkout(ttl); err != ErrPoolExhausted {
+		t.Fatalf("Checkout during cooldown = %v, want ErrPoolExhausted", err)
+	}
+
+	// The jar was saved on return.
+	time.Sleep(time.Second)
+	a, err = pool.Checkout(ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookies := a.Jar.Cookies(foobarUrl); len(cookies) != 1 || cookies[0].Value != testCookie1.Value {
+		t.Errorf("cookies after checkout = %v", cookies)
+	}
+
+	// Healing makes the identity available again, and adding it does not
+	// disturb a checkout.
+	if err := pool.Heal(second); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Add(first, second); err != nil {
+		t.Fatal(err)
+	}
+	status, err = pool.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Idle) != 1 || status.Idle[0] != second || len(status.Unhealthy) != 0 {
+		t.Errorf("status after heal = %+v", status)
+	}
+	if _, ok := status.Busy[first]; !ok {
+		t.Errorf("%s not busy: %+v", first, status)
+	}
+
+	if err := pool.Remove(first, second); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Return(0); err != ErrNotCheckedOut {
+		t.Errorf("Return after Remove = %v, want ErrNotCheckedOut", err)
+	}
+}
+
+func TestPoolExpiredCheckout(t *testing.T) {
+	cl, newKey := testClient(t)
+
+	ns := newKey("testPoolExpired")
+	pool := NewPool(cl, ns)
+	if err := pool.Add(ns + ":id"); err != nil {
+		t.Fatal(err)
+	}
+
+	const ttl = 300 * time.Millisecond
+	a, err := pool.Checkout(ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The checkout expires while the worker still holds the lease, so the
+	// identity is not handed out again until the lease expires.
+	cl.ZAdd(pool.keyName("busy"), redis.Z{Score: 0, Member: a.Key})
+	if _, err := pool.Checkout(ttl); err != ErrPoolExhausted {
+		t.Fatalf("Checkout of leased identity = %v, want ErrPoolExhausted", err)
+	}
+	if err := a.Return(0); err != ErrNotCheckedOut {
+		t.Errorf("Return of expired checkout = %v, want ErrNotCheckedOut", err)
+	}
+	time.Sleep(2 * ttl)
+
+	b, err := pool.Checkout(ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Return(0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolHashTag(t *testing.T) {
+	cl, newKey := testClient(t)
+
+	ns := newKey("testPoolHashTag")
+	pool := NewPool(cl, ns)
+	pool.StoreOptions = []Option{HashTag}
+	if err := pool.Add(ns + ":id"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lease is taken on the tagged key, so saves are not fenced off.
+	a, err := pool.Checkout(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Jar.SetCookies(foobarUrl, []*http.Cookie{testCookie1})
+	if err := a.Return(0); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := NewRedisCookieStore(cl, a.Key, HashTag).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entries["foobar.com"]["foobar.com;/;testCookie1"]; !ok {
+		t.Errorf("entries after return = %v", entries)
+	}
+}
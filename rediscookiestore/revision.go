@@ -0,0 +1,277 @@
+package rediscookiestore
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/rmdashrf/go-misc/cookiejar2"
+)
+
+// MetaName returns the name of the hash holding the metadata of the store
+// with the given key. Its "rev" field is the revision of the store, which
+// every save increments, and its "written" field the time of the last save,
+// in milliseconds since the epoch.
+func MetaName(key string) string {
+	return fmt.Sprintf("%s:meta", key)
+}
+
+// Invalidation is the message published on InvalidationName(key) by every
+// save, encoded as JSON. Writers that predate it publish their bare id
+// instead, which receivers treat as an Invalidation without a Delta.
+type Invalidation struct {
+	// Writer is the id of the store that saved.
+	Writer string `json:"writer"`
+
+	// Rev is the revision of the store after the save.
+	Rev int64 `json:"rev"`
+
+	// Delta holds the changes of the save. It is only set if the writer knew
+	// the contents of the store at revision Rev-1, so that a receiver at that
+	// revision can apply it instead of reloading.
+	Delta []*DomainChanges `json:"delta,omitempty"`
+}
+
+// DomainChanges are the changes to the cookies of one eTLD+1 domain. Upserts
+// maps cookie ids to their JSON encoded entries.
+type DomainChanges struct {
+	Domain  string            `json:"domain"`
+	Upserts map[string]string `json:"upserts,omitempty"`
+	Deletes []string          `json:"deletes,omitempty"`
+}
+
+// parseInvalidation decodes an invalidation message. ok is false for
+// messages of older writers, which only hold the writer's id.
+func parseInvalidation(payload string) (msg Invalidation, ok bool) {
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil || msg.Rev == 0 {
+		return Invalidation{Writer: payload}, false
+	}
+	return msg, true
+}
+
+// encodedEntries holds JSON encoded entries by eTLD+1 and id, so that they
+// can be compared and sent as deltas.
+type encodedEntries map[string]map[string]string
+
+func encodeEntries(entries cookiejar2.CookieEntries) (encodedEntries, error) {
+	ret := make(encodedEntries, len(entries))
+	for domain, submap := range entries {
+		encoded := make(map[string]string, len(submap))
+		for id, e := range submap {
+			val, err := json.Marshal(e)
+			if err != nil {
+				return nil, err
+			}
+			encoded[id] = string(val)
+		}
+		ret[domain] = encoded
+	}
+	return ret, nil
+}
+
+func (e encodedEntries) decode() (cookiejar2.CookieEntries, error) {
+	ret := make(cookiejar2.CookieEntries, len(e))
+	for domain, encoded := range e {
+		submap := make(map[string]cookiejar2.Entry, len(encoded))
+		for id, val := range encoded {
+			var entry cookiejar2.Entry
+			if err := json.Unmarshal([]byte(val), &entry); err != nil {
+				return nil, fmt.Errorf("rediscookiestore: cookie %s: %v", id, err)
+			}
+			submap[id] = entry
+		}
+		ret[domain] = submap
+	}
+	return ret, nil
+}
+
+// diff returns the changes that turn e into next, in no particular order.
+func (e encodedEntries) diff(next encodedEntries) []*DomainChanges {
+	changes := make(map[string]*DomainChanges)
+	change := func(domain string) *DomainChanges {
+		c, ok := changes[domain]
+		if !ok {
+			c = &DomainChanges{Domain: domain}
+			changes[domain] = c
+		}
+		return c
+	}
+
+	for domain, encoded := range next {
+		for id, val := range encoded {
+			if old, ok := e[domain][id]; !ok || old != val {
+				c := change(domain)
+				if c.Upserts == nil {
+					c.Upserts = make(map[string]string)
+				}
+				c.Upserts[id] = val
+			}
+		}
+	}
+
+	for domain, encoded := range e {
+		for id := range encoded {
+			if _, ok := next[domain][id]; !ok {
+				c := change(domain)
+				c.Deletes = append(c.Deletes, id)
+			}
+		}
+	}
+
+	ret := make([]*DomainChanges, 0, len(changes))
+	for _, c := range changes {
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+func (e encodedEntries) equal(other encodedEntries) bool {
+	if len(e) != len(other) {
+		return false
+	}
+	for domain, encoded := range e {
+		if len(encoded) != len(other[domain]) {
+			return false
+		}
+		for id, val := range encoded {
+			if v, ok := other[domain][id]; !ok || v != val {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// clone returns a copy of e.
+func (e encodedEntries) clone() encodedEntries {
+	ret := make(encodedEntries, len(e))
+	for domain, encoded := range e {
+		c := make(map[string]string, len(encoded))
+		for id, val := range encoded {
+			c[id] = val
+		}
+		ret[domain] = c
+	}
+	return ret
+}
+
+// apply applies changes to e in place.
+func (e encodedEntries) apply(changes []*DomainChanges) {
+	for _, c := range changes {
+		encoded := e[c.Domain]
+		if encoded == nil {
+			encoded = make(map[string]string, len(c.Upserts))
+			e[c.Domain] = encoded
+		}
+		for id, val := range c.Upserts {
+			encoded[id] = val
+		}
+		for _, id := range c.Deletes {
+			delete(encoded, id)
+		}
+		if len(encoded) == 0 {
+			delete(e, c.Domain)
+		}
+	}
+}
+
+// revCache is a store's local copy of its entries, at a revision.
+type revCache struct {
+	// rev is the latest revision the store has seen, through its own loads
+	// and saves or through invalidation messages.
+	rev int64
+
+	// entries are the entries at rev, unless stale is set. Stale entries
+	// are kept as a baseline for computing changes.
+	entries encodedEntries
+	stale   bool
+
+	// applied is set when a delta was applied to entries since they were
+	// last returned by Load, so that Load can return them without reading
+	// the store.
+	applied bool
+}
+
+func newRevCache() revCache {
+	return revCache{entries: make(encodedEntries), stale: true}
+}
+
+// set records that the store holds entries at rev.
+func (c *revCache) set(rev int64, entries encodedEntries) {
+	c.rev = rev
+	c.entries = entries
+	c.stale = false
+	c.applied = false
+}
+
+// take returns the entries if a delta was applied to them since the last
+// call, and clears the flag.
+func (c *revCache) take() (encodedEntries, bool) {
+	if c.stale || !c.applied {
+		return nil, false
+	}
+	c.applied = false
+	return c.entries, true
+}
+
+// seen records that the store has seen rev, without knowing its entries.
+func (c *revCache) seen(rev int64) {
+	if rev > c.rev {
+		c.rev = rev
+	}
+	c.stale = true
+}
+
+// resync compares the current revision of the store with the latest one
+// seen, and reports whether the jar must reload because invalidations were
+// missed.
+func (c *revCache) resync(rev int64) bool {
+	if rev <= c.rev {
+		return false
+	}
+	c.seen(rev)
+	return true
+}
+
+// base returns the revision deltas computed against c.entries apply to, or
+// -1 if they do not apply to any revision.
+func (c *revCache) base() int64 {
+	if c.stale {
+		return -1
+	}
+	return c.rev
+}
+
+// handle processes the invalidation message payload, and reports whether the
+// jar must reload. Messages for revisions already seen are skipped, and
+// deltas that directly follow the cached revision are applied to the cache.
+func (c *revCache) handle(payload, id string) bool {
+	msg, ok := parseInvalidation(payload)
+	if !ok {
+		if msg.Writer == id {
+			return false
+		}
+		c.stale = true
+		return true
+	}
+
+	if msg.Writer == id {
+		// The store knows its own saves.
+		if msg.Rev > c.rev {
+			c.rev = msg.Rev
+		}
+		return false
+	}
+
+	if msg.Rev <= c.rev {
+		return false
+	}
+
+	if !c.stale && msg.Delta != nil && msg.Rev == c.rev+1 {
+		c.entries.apply(msg.Delta)
+		c.applied = true
+	} else {
+		c.stale = true
+	}
+	c.rev = msg.Rev
+	return true
+}
@@ -1,42 +1,197 @@
 package rediscookiestore
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/rmdashrf/go-misc/cookiejar2"
 )
 
 var (
-	// SETANDPUB <setkey> <pubkey> <val> <token>
-	// will set <setkey> to <val>, and then publish <token>
-	// to the pubsub key <pubkey>
+	// SETANDPUB <setkey> <pubkey> <metakey> <streamkey> <leasekey> <historykey> <val> <token> <base> <delta> <maxlen> <fence> <now> <ttl> <history>
+	// will set <setkey> to <val>, increment the "rev" field of <metakey> and
+	// set its "written" field to <now>, and then publish an Invalidation from
+	// <token> to the pubsub key <pubkey>, and add it to the stream
+	// <streamkey> trimmed to about <maxlen> entries unless <maxlen> is 0.
+	// The JSON encoded <delta> is included if the new revision directly
+	// follows <base>. Returns the new revision. Unless <fence> is empty,
+	// nothing is done and a FENCED error is returned if <leasekey> does not
+	// hold <fence>, and a HASHSTORE error is returned if <setkey> holds the
+	// domain set of a HashCookieStore. Unless <history> is 0, <val> is also
+	// pushed to the list <historykey> as a Version, which is trimmed to
+	// <history> entries. If <ttl> is positive, <setkey>, <metakey>,
+	// <streamkey> and <historykey> expire in <ttl> milliseconds; if it is
+	// negative, their expiry is removed, and if it is 0, it is left as it is.
+	// Unless <ttl> is 0, a <metakey> without a revision, such as one that
+	// expired, starts its revisions from <now>.
 	scriptSetAndPublishSrc = `
 local val = ARGV[1]
 local token = ARGV[2]
+local base = tonumber(ARGV[3])
+local delta = ARGV[4]
+local maxlen = tonumber(ARGV[5])
+local fence = ARGV[6]
+local now = ARGV[7]
+local ttl = tonumber(ARGV[8])
 local key = KEYS[1]
 local publish_key = KEYS[2]
+local meta_key = KEYS[3]
+local stream_key = KEYS[4]
+local lease_key = KEYS[5]
+local history_key = KEYS[6]
+local history = tonumber(ARGV[9])
 
+if fence ~= "" and redis.call("GET", lease_key) ~= fence then
+	return redis.error_reply("FENCED lease not held")
+end
+if redis.call("TYPE", key).ok == "set" then
+	return redis.error_reply("HASHSTORE key holds a hash store")
+end
+
+-- SET removes the expiry of the key, which is kept unless ttl is set.
+local pttl = redis.call("PTTL", key)
 redis.call("SET", key, val)
-redis.call("PUBLISH", publish_key, token)
-return "OK"
+if ttl == 0 and pttl > 0 then
+	redis.call("PEXPIRE", key, pttl)
+end
+if ttl ~= 0 and redis.call("HEXISTS", meta_key, "rev") == 0 then
+	redis.call("HSET", meta_key, "rev", now)
+end
+local rev = redis.call("HINCRBY", meta_key, "rev", 1)
+redis.call("HSET", meta_key, "written", now)
+
+local msg = '{"writer":' .. cjson.encode(token) .. ',"rev":' .. rev
+if delta ~= "" and base == rev - 1 then
+	msg = msg .. ',"delta":' .. delta
+end
+msg = msg .. "}"
+redis.call("PUBLISH", publish_key, msg)
+if maxlen > 0 then
+	redis.call("XADD", stream_key, "MAXLEN", "~", maxlen, "*", "msg", msg)
+end
+if history > 0 then
+	local header = '{"writer":' .. cjson.encode(token) .. ',"rev":' .. rev .. ',"time":' .. now .. '}'
+	redis.call("LPUSH", history_key, header .. "\n" .. val)
+	redis.call("LTRIM", history_key, 0, history - 1)
+end
+if ttl > 0 then
+	redis.call("PEXPIRE", key, ttl)
+	redis.call("PEXPIRE", meta_key, ttl)
+	redis.call("PEXPIRE", stream_key, ttl)
+	redis.call("PEXPIRE", history_key, ttl)
+elseif ttl < 0 then
+	redis.call("PERSIST", key)
+	redis.call("PERSIST", meta_key)
+	redis.call("PERSIST", stream_key)
+	redis.call("PERSIST", history_key)
+end
+return rev
 `
 	scriptSetAndPub = redis.NewScript(scriptSetAndPublishSrc)
+
+	// GETWITHREV <getkey> <metakey>
+	// returns the value of <getkey> and the "rev" field of <metakey>.
+	scriptGetWithRevSrc = `
+return {redis.call("GET", KEYS[1]), redis.call("HGET", KEYS[2], "rev")}
+`
+	scriptGetWithRev = redis.NewScript(scriptGetWithRevSrc)
 )
 
-func SetCookies(r *redis.Client, key string, entries cookiejar2.CookieEntries, id string) (err error) {
+// ErrHashStore is returned by SetCookies and SetBlob when the key holds a
+// HashCookieStore, which they would overwrite. The store was not modified.
+var ErrHashStore = errors.New("rediscookiestore: key holds a hash store")
+
+// hashStorePrefix starts the error replies of SETANDPUB when the key holds a
+// HashCookieStore.
+const hashStorePrefix = "HASHSTORE"
+
+// IsHashStore reports whether the store with the given key was saved by a
+// HashCookieStore, whose entries are not stored as a blob.
+func IsHashStore(r redis.UniversalClient, key string) (bool, error) {
+	typ, err := r.Type(StoreName(key)).Result()
+	return typ == "set", err
+}
+
+func SetCookies(r redis.UniversalClient, key string, entries cookiejar2.CookieEntries, id string) (err error) {
 	var contents []byte
-	contents, err = json.Marshal(entries)
+	contents, err = cookiejar2.MarshalEntries(entries)
 	if err != nil {
 		return
 	}
 
-	storeName := StoreName(key)
-	invalidationName := InvalidationName(key)
-	err = scriptSetAndPub.Run(r, []string{storeName, invalidationName}, contents, id).Err()
+	return SetBlob(r, key, contents, id)
+}
+
+// SetBlob is like SetCookies, but stores already serialized entries. Neither
+// changes the expiry of the keys of stores saved WithKeyExpiry, which their
+// next save refreshes.
+func SetBlob(r redis.UniversalClient, key string, contents []byte, id string) (err error) {
+	_, err = setBlob(r, key, contents, id, -1, nil, newOptions(nil), 0)
 	return
+}
+
+// setBlob stores contents, and publishes delta with the invalidation if it
+// holds the changes from revision base. The expiry of the keys is set
+// according to ttl, like SETANDPUB does, and contents are added to the
+// history of the store if opts keep one. It returns the new revision, or
+// ErrFenced if the lease of opts is no longer held, or ErrHashStore.
+func setBlob(r redis.UniversalClient, key string, contents []byte, id string, base int64, delta []byte, opts *options, ttl int64) (int64, error) {
+	keys := []string{StoreName(key), InvalidationName(key), MetaName(key), StreamName(key), LeaseName(key), HistoryName(key)}
+	rev, err := scriptSetAndPub.Run(r, keys, contents, id, base, delta, opts.StreamMaxLen, opts.Lease.fence(),
+		unixMillis(time.Now()), ttl, opts.History).Int64()
+	if err != nil && strings.HasPrefix(err.Error(), hashStorePrefix) {
+		return 0, ErrHashStore
+	}
+	return rev, fenced(err)
+}
 
+// getBlob returns the stored contents, nil if there are none, and the
+// revision of the store.
+func getBlob(r redis.UniversalClient, key string) ([]byte, int64, error) {
+	res, err := scriptGetWithRev.Run(r, []string{StoreName(key), MetaName(key)}).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) != 2 {
+		return nil, 0, fmt.Errorf("rediscookiestore: unexpected load result %T", res)
+	}
+
+	var contents []byte
+	if s, ok := vals[0].(string); ok {
+		contents = []byte(s)
+	}
+
+	return contents, parseRev(vals[1]), nil
+}
+
+// parseRev parses a revision returned by a script, which is nil for stores
+// that have never been saved.
+func parseRev(v interface{}) int64 {
+	var rev int64
+	switch v := v.(type) {
+	case int64:
+		rev = v
+	case string:
+		fmt.Sscan(v, &rev)
+	}
+	return rev
+}
+
+// HashTagged returns prefix wrapped in braces, so that Redis Cluster hashes
+// all the keys of a store with that key to the same slot. Prefixes that
+// already contain a hash tag are returned unchanged.
+func HashTagged(prefix string) string {
+	if i := strings.Index(prefix, "{"); i >= 0 {
+		if j := strings.Index(prefix[i+1:], "}"); j > 0 {
+			return prefix
+		}
+	}
+	return "{" + prefix + "}"
 }
 
 func StoreName(key string) string {
@@ -3,8 +3,8 @@ package rediscookiestore
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -12,62 +12,103 @@ import (
 )
 
 type RedisCookieStore struct {
-	redis        *redis.Client
+	redis        redis.UniversalClient
 	id           string
 	storeKey     string
 	invalidateCh chan struct{}
+	opts         *options
+	listener     *listener
+
+	// mu serializes Load and Save with the handling of invalidation
+	// messages, and locks cache.
+	mu    sync.Mutex
+	cache revCache
 }
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-func NewRedisCookieStore(redis *redis.Client, storePrefix string) *RedisCookieStore {
-	id := rand.Int63()
+// newStoreID returns a random id, used to recognize the invalidation messages
+// published by a store itself.
+func newStoreID() string {
+	return fmt.Sprintf("%d", rand.Int63())
+}
 
+func NewRedisCookieStore(redis redis.UniversalClient, storePrefix string, opts ...Option) *RedisCookieStore {
+	options := newOptions(opts)
 	store := &RedisCookieStore{
 		redis:        redis,
-		id:           fmt.Sprintf("%d", id),
-		storeKey:     storePrefix,
+		id:           newStoreID(),
+		storeKey:     options.key(storePrefix),
 		invalidateCh: make(chan struct{}, 1),
+		opts:         options,
+		cache:        newRevCache(),
+		listener:     newListener(),
 	}
 
-	go store.listenForInvalidations()
+	if store.opts.StreamInvalidation {
+		go store.listener.listenStream(store.redis, store.storeKey, store.handleInvalidation, store.resync)
+	} else {
+		go store.listener.listenPubSub(store.redis, store.storeKey, store.handleInvalidation, store.resync, store.reload)
+	}
 
 	return store
 }
 
-func (r *RedisCookieStore) listenForInvalidations() {
-	var (
-		invName = InvalidationName(r.storeKey)
-		err     error
-	)
-
-	for {
-		pubsub := r.redis.Subscribe(invName)
-		if err != nil {
-			log.Printf("Failed to subscribe to %s: %v\n", invName, err)
-			time.Sleep(1 * time.Second)
-			continue
-		}
+// State returns the state of the connection the store receives
+// invalidations on, and the error that caused the last reconnect, if any.
+func (r *RedisCookieStore) State() (ConnState, error) {
+	return r.listener.State()
+}
 
-		for {
-			msg, err := pubsub.ReceiveMessage()
-			if err != nil {
-				log.Printf("Failed to receive invalidation message: %v\n", err)
-				continue
-			}
-
-			if msg.Payload == r.id {
-				// ignore messages generated by ourself
-				continue
-			}
-
-			select {
-			case r.invalidateCh <- struct{}{}:
-			default:
-			}
-		}
+// Close stops receiving invalidations. The store can still be loaded and
+// saved.
+func (r *RedisCookieStore) Close() error {
+	return r.listener.Close()
+}
+
+// reload makes the jar reload from the store.
+func (r *RedisCookieStore) reload() {
+	r.mu.Lock()
+	r.cache.stale = true
+	r.mu.Unlock()
+
+	invalidate(r.invalidateCh)
+}
+
+// resync reloads if the store has revisions that were not seen.
+func (r *RedisCookieStore) resync() error {
+	rev, err := storeRev(r.redis, r.storeKey)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	reload := r.cache.resync(rev)
+	r.mu.Unlock()
+
+	if reload {
+		invalidate(r.invalidateCh)
+	}
+	return nil
+}
+
+func (r *RedisCookieStore) handleInvalidation(payload string) {
+	r.mu.Lock()
+	reload := r.cache.handle(payload, r.id)
+	r.mu.Unlock()
+
+	if reload {
+		invalidate(r.invalidateCh)
+	}
+}
+
+// invalidate sends an invalidation event on ch, unless one is pending.
+func invalidate(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
 	}
 }
 
@@ -75,22 +116,108 @@ func (r *RedisCookieStore) InvalidationEvents() <-chan struct{} {
 	return r.invalidateCh
 }
 
+// Load returns the entries of the store. When it is called to reload after a
+// delta published with an invalidation message was applied to the local copy
+// of the entries, that copy is returned without reading the store.
 func (r *RedisCookieStore) Load() (ret cookiejar2.CookieEntries, err error) {
-	storeName := StoreName(r.storeKey)
-	content, err := r.redis.Get(storeName).Bytes()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if encoded, ok := r.cache.take(); ok {
+		return encoded.decode()
+	}
+
+	content, rev, err := getBlob(r.redis, r.storeKey)
 	if err != nil {
-		if err == redis.Nil {
-			return make(cookiejar2.CookieEntries), nil
+		return nil, err
+	}
+
+	entries := make(cookiejar2.CookieEntries)
+	if content != nil {
+		if entries, err = cookiejar2.UnmarshalEntries(content); err != nil {
+			return nil, err
 		}
+	}
+
+	encoded, err := encodeEntries(entries)
+	if err != nil {
 		return nil, err
 	}
+	r.cache.set(rev, encoded)
 
-	err = json.Unmarshal(content, &ret)
-	return
+	return entries, nil
 }
 
+// Save saves entries, and publishes the changes since the revision of the
+// local copy of the entries along with the invalidation.
 func (r *RedisCookieStore) Save(entries cookiejar2.CookieEntries) (err error) {
-	return SetCookies(r.redis, r.storeKey, entries, r.id)
+	contents, err := cookiejar2.MarshalEntries(entries)
+	if err != nil {
+		return err
+	}
+	encoded, err := encodeEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	base := r.cache.base()
+	var delta []byte
+	if base >= 0 {
+		if delta, err = json.Marshal(r.cache.entries.diff(encoded)); err != nil {
+			return err
+		}
+		// Receivers are better off reloading than applying a delta that is
+		// larger than the entries.
+		if len(delta) > len(contents) {
+			delta = nil
+		}
+	}
+
+	rev, err := setBlob(r.redis, r.storeKey, contents, r.id, base, delta, r.opts, r.opts.keyTTL(entries, time.Now()))
+	if err != nil {
+		return err
+	}
+
+	// The save replaced whatever other writers saved before it.
+	r.cache.set(rev, encoded)
+	return nil
 }
 
-var _ cookiejar2.EntryStorage = (*RedisCookieStore)(nil)
+// LoadBlob returns the serialized entries, or nil if the store is empty.
+func (r *RedisCookieStore) LoadBlob() ([]byte, error) {
+	content, rev, err := getBlob(r.redis, r.storeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.cache.seen(rev)
+	r.mu.Unlock()
+
+	return content, nil
+}
+
+// SaveBlob stores already serialized entries, such as those written by
+// cookiejar2.EncryptedStorage. No delta is published, as the entries may be
+// encrypted. For the same reason, the expiries of the cookies are unknown,
+// and the keys of the store are given the idle TTL of WithKeyExpiry.
+func (r *RedisCookieStore) SaveBlob(contents []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rev, err := setBlob(r.redis, r.storeKey, contents, r.id, -1, nil, r.opts, r.opts.keyTTL(nil, time.Now()))
+	if err != nil {
+		return err
+	}
+
+	r.cache.seen(rev)
+	return nil
+}
+
+var (
+	_ cookiejar2.EntryStorage = (*RedisCookieStore)(nil)
+	_ cookiejar2.BlobStorage  = (*RedisCookieStore)(nil)
+)
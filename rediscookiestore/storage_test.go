@@ -1,15 +1,20 @@
 package rediscookiestore
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/rmdashrf/go-misc/cookiejar2"
+	"github.com/rmdashrf/go-misc/cookiejar2/storagetest"
 )
 
 var (
@@ -27,6 +32,38 @@ var (
 	anotherUrl, _ = url.Parse("http://another.com")
 )
 
+// testClient returns a client of the Redis server at localhost:6379, and
+// skips the test if it is unavailable. newKey returns a new store key or
+// namespace starting with prefix; the keys under it are deleted when the
+// test ends.
+func testClient(t *testing.T) (cl *redis.Client, newKey func(prefix string) string) {
+	cl = redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	if err := cl.Ping().Err(); err != nil {
+		cl.Close()
+		t.Skipf("redis unavailable: %v", err)
+	}
+
+	var names []string
+	t.Cleanup(func() {
+		for _, name := range names {
+			for _, match := range []string{name + ":*", "{" + name + "}*", "{" + name + ":*"} {
+				if keys, _ := cl.Keys(match).Result(); len(keys) > 0 {
+					cl.Del(keys...)
+				}
+			}
+		}
+		cl.Close()
+	})
+
+	return cl, func(prefix string) string {
+		name := fmt.Sprintf("%s-%d", prefix, rand.Int())
+		names = append(names, name)
+		return name
+	}
+}
+
 func TestNoStorage(t *testing.T) {
 	cj := cookiejar2.New(nil)
 	cj.SetCookies(foobarUrl, []*http.Cookie{testCookie1})
@@ -47,10 +84,8 @@ func TestNoStorage(t *testing.T) {
 }
 
 func TestRedisPersistence(t *testing.T) {
-	tmpname := fmt.Sprintf("testRedisStore-%d", rand.Int())
-	cl := redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-	})
+	cl, newKey := testClient(t)
+	tmpname := newKey("testRedisStore")
 
 	redisStore := NewRedisCookieStore(cl, tmpname)
 
@@ -93,3 +128,568 @@ func TestRedisPersistence(t *testing.T) {
 	}
 
 }
+
+func TestRedisConformance(t *testing.T) {
+	cl, newKey := testClient(t)
+
+	storagetest.Run(t, func(t *testing.T) (a, b cookiejar2.EntryStorage) {
+		tmpname := newKey("testRedisStore")
+		a = NewRedisCookieStore(cl, tmpname)
+		b = NewRedisCookieStore(cl, tmpname)
+		waitConnected(t, a, b)
+		return a, b
+	})
+}
+
+func TestHashConformance(t *testing.T) {
+	cl, newKey := testClient(t)
+
+	storagetest.Run(t, func(t *testing.T) (a, b cookiejar2.EntryStorage) {
+		tmpname := newKey("testHashStore")
+		a = NewHashCookieStore(cl, tmpname)
+		b = NewHashCookieStore(cl, tmpname)
+		waitConnected(t, a, b)
+		return a, b
+	})
+}
+
+func TestHashStoreConcurrentWriters(t *testing.T) {
+	cl, newKey := testClient(t)
+
+	tmpname := newKey("testHashStore")
+	store2 := NewHashCookieStore(cl, tmpname)
+	defer store2.Close()
+	cj1 := cookiejar2.New(&cookiejar2.Options{
+		Storage:             NewHashCookieStore(cl, tmpname),
+		IgnoreInvalidations: true,
+	})
+	cj2 := cookiejar2.New(&cookiejar2.Options{
+		Storage:             store2,
+		IgnoreInvalidations: true,
+	})
+	waitState(t, store2.State, StateConnected)
+
+	// Neither jar sees the other's cookie, yet neither save removes it, even
+	// after the second store received the first save's delta.
+	cj1.SetCookies(foobarUrl, []*http.Cookie{testCookie1})
+	cj1.SaveCookies()
+	select {
+	case <-store2.InvalidationEvents():
+	case <-time.After(time.Second):
+		t.Fatal("second store received no invalidation")
+	}
+	cj2.SetCookies(anotherUrl, []*http.Cookie{testCookie2})
+	cj2.SaveCookies()
+
+	entries, err := NewHashCookieStore(cl, tmpname).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := entries["foobar.com"]["foobar.com;/;testCookie1"]; !exists {
+		t.Fatal("first writer's cookie was overwritten")
+	}
+	if _, exists := entries["another.com"]["another.com;/;testCookie2"]; !exists {
+		t.Fatal("second writer's cookie is missing")
+	}
+
+	// Deleting the last cookie of a domain removes the domain.
+	cj1.SetCookies(foobarUrl, []*http.Cookie{{Name: testCookie1.Name, MaxAge: -1}})
+	cj1.SaveCookies()
+	domains, err := cl.SMembers(StoreName(tmpname)).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 1 || domains[0] != "another.com" {
+		t.Fatalf("expected [another.com], got %v", domains)
+	}
+}
+
+func TestSetBlobOnHashStore(t *testing.T) {
+	cl, newKey := testClient(t)
+
+	tmpname := newKey("testHashStore")
+	store := NewHashCookieStore(cl, tmpname)
+	defer store.Close()
+	if err := store.Save(storagetest.Entries()); err != nil {
+		t.Fatal(err)
+	}
+
+	if hash, err := IsHashStore(cl, tmpname); !hash || err != nil {
+		t.Fatalf("IsHashStore = %v, %v, want true", hash, err)
+	}
+	if err := SetCookies(cl, tmpname, make(cookiejar2.CookieEntries), "test"); err != ErrHashStore {
+		t.Fatalf("SetCookies on a hash store = %v, want ErrHashStore", err)
+	}
+	entries, err := NewHashCookieStore(cl, tmpname).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("hash store was modified")
+	}
+
+	if hash, err := IsHashStore(cl, tmpname+"-blob"); hash || err != nil {
+		t.Fatalf("IsHashStore of a missing store = %v, %v, want false", hash, err)
+	}
+}
+
+func TestDeltaInvalidation(t *testing.T) {
+	cl, newKey := testClient(t)
+
+	for name, newStore := range map[string]func(*redis.Client, string) cookiejar2.EntryStorage{
+		"blob": func(cl *redis.Client, prefix string) cookiejar2.EntryStorage { return NewRedisCookieStore(cl, prefix) },
+		"hash": func(cl *redis.Client, prefix string) cookiejar2.EntryStorage { return NewHashCookieStore(cl, prefix) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			tmpname := newKey("testDelta")
+			writer := newStore(cl, tmpname)
+			reader := newStore(cl, tmpname)
+			waitConnected(t, writer, reader)
+
+			waitInvalidation := func() {
+				t.Helper()
+				select {
+				case <-reader.InvalidationEvents():
+				case <-time.After(time.Second):
+					t.Fatal("no invalidation")
+				}
+			}
+
+			entries := cookiejar2.CookieEntries{
+				"foobar.com": {"foobar.com;/;a": {Name: "a", Value: "1", Domain: "foobar.com", Path: "/"}},
+			}
+			if err := writer.Save(entries); err != nil {
+				t.Fatal(err)
+			}
+			waitInvalidation()
+			if _, err := reader.Load(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The next save carries a delta, which the reader applies without
+			// reading the store.
+			entries["foobar.com"]["foobar.com;/;b"] = cookiejar2.Entry{Name: "b", Value: "2", Domain: "foobar.com", Path: "/"}
+			if err := writer.Save(entries); err != nil {
+				t.Fatal(err)
+			}
+			waitInvalidation()
+
+			keys, _ := cl.Keys(tmpname + ":*").Result()
+			cl.Del(keys...)
+
+			loaded, err := reader.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(loaded["foobar.com"]) != 2 {
+				t.Fatalf("delta not applied: %v", loaded)
+			}
+
+			// Replayed messages are skipped.
+			cl.Publish(InvalidationName(tmpname), `{"writer":"other","rev":1}`)
+			select {
+			case <-reader.InvalidationEvents():
+				t.Fatal("stale revision caused a reload")
+			case <-time.After(200 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestStreamConformance(t *testing.T) {
+	cl, newKey := testClient(t)
+
+	storagetest.Run(t, func(t *testing.T) (a, b cookiejar2.EntryStorage) {
+		tmpname := newKey("testStreamStore")
+		a = NewRedisCookieStore(cl, tmpname, StreamInvalidation)
+		b = NewRedisCookieStore(cl, tmpname, StreamInvalidation)
+		waitConnected(t, a, b)
+		return a, b
+	})
+}
+
+// flakyDialer dials localhost:6379, and can be taken down to simulate a
+// Redis restart.
+type flakyDialer struct {
+	mu    sync.Mutex
+	down  bool
+	conns []net.Conn
+	dials int
+}
+
+func (d *flakyDialer) dial() (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials++
+	if d.down {
+		return nil, errors.New("flakyDialer: down")
+	}
+	conn, err := net.Dial("tcp", "localhost:6379")
+	if err == nil {
+		d.conns = append(d.conns, conn)
+	}
+	return conn, err
+}
+
+func (d *flakyDialer) dialCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials
+}
+
+func (d *flakyDialer) setDown(down bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.down = down
+	if down {
+		for _, c := range d.conns {
+			c.Close()
+		}
+		d.conns = nil
+	}
+}
+
+func TestStreamGapRecovery(t *testing.T) {
+	cl, newKey := testClient(t)
+
+	dialer := &flakyDialer{}
+	flaky := redis.NewClient(&redis.Options{
+		Dialer: dialer.dial,
+	})
+
+	tmpname := newKey("testStreamGap")
+	writer := NewRedisCookieStore(cl, tmpname)
+	reader := NewRedisCookieStore(flaky, tmpname, StreamInvalidation)
+	time.Sleep(100 * time.Millisecond)
+
+	entries := cookiejar2.CookieEntries{
+		"foobar.com": {"foobar.com;/;a": {Name: "a", Value: "1", Domain: "foobar.com", Path: "/"}},
+	}
+	if err := writer.Save(entries); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reader.InvalidationEvents():
+	case <-time.After(time.Second):
+		t.Fatal("no invalidation")
+	}
+	if _, err := reader.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Saves while the reader is disconnected, and trimmed from the stream
+	// before it reconnects, still cause a reload.
+	dialer.setDown(true)
+	for i := 0; i < 3; i++ {
+		if err := writer.Save(entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cl.XTrim(StreamName(tmpname), 0)
+	time.Sleep(200 * time.Millisecond)
+	dialer.setDown(false)
+
+	select {
+	case <-reader.InvalidationEvents():
+	case <-time.After(3 * time.Second):
+		t.Fatal("missed invalidations did not cause a reload")
+	}
+}
+
+// waitState waits for the state of a store to become want.
+func waitState(t *testing.T, state func() (ConnState, error), want ConnState) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		got, _ := state()
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("state = %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitConnected waits until the listeners of stores are connected, and have
+// resynced the stores.
+func waitConnected(t *testing.T, stores ...cookiejar2.EntryStorage) {
+	t.Helper()
+	for _, s := range stores {
+		waitState(t, s.(interface{ State() (ConnState, error) }).State, StateConnected)
+	}
+}
+
+func TestPubSubReconnect(t *testing.T) {
+	cl, newKey := testClient(t)
+
+	// The pooled connections are closed along with the pubsub connection;
+	// retry the commands that fail on them.
+	dialer := &flakyDialer{}
+	flaky := redis.NewClient(&redis.Options{
+		Dialer:     dialer.dial,
+		MaxRetries: 1,
+	})
+
+	tmpname := newKey("testPubSubReconnect")
+	writer := NewRedisCookieStore(cl, tmpname)
+	defer writer.Close()
+	reader := NewRedisCookieStore(flaky, tmpname)
+	waitState(t, reader.State, StateConnected)
+
+	entries := cookiejar2.CookieEntries{
+		"foobar.com": {"foobar.com;/;a": {Name: "a", Value: "1", Domain: "foobar.com", Path: "/"}},
+	}
+	if _, err := reader.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// While Redis is down, the reader backs off instead of spinning.
+	dialer.setDown(true)
+	waitState(t, reader.State, StateReconnecting)
+	if _, err := reader.State(); err == nil {
+		t.Error("no error while reconnecting")
+	}
+	if err := writer.Save(entries); err != nil {
+		t.Fatal(err)
+	}
+	dials := dialer.dialCount()
+	time.Sleep(time.Second)
+	if n := dialer.dialCount() - dials; n > 10 {
+		t.Errorf("%d dials in a second while down", n)
+	}
+
+	// The save published while the reader was disconnected still causes a
+	// reload once it resubscribes.
+	dialer.setDown(false)
+	select {
+	case <-reader.InvalidationEvents():
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconnect did not cause a reload")
+	}
+	waitState(t, reader.State, StateConnected)
+
+	got, err := reader.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !storagetest.Equal(got, entries) {
+		t.Errorf("Load after reconnect = %v, want %v", got, entries)
+	}
+
+	// Invalidations are received again after resubscribing.
+	entries["foobar.com"]["foobar.com;/;a"] = cookiejar2.Entry{Name: "a", Value: "2", Domain: "foobar.com", Path: "/"}
+	if err := writer.Save(entries); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reader.InvalidationEvents():
+	case <-time.After(time.Second):
+		t.Fatal("no invalidation after reconnect")
+	}
+
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := reader.State(); state != StateClosed {
+		t.Errorf("state after Close = %v", state)
+	}
+	if err := reader.Close(); err != ErrClosed {
+		t.Errorf("second Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestCloseStream(t *testing.T) {
+	cl, newKey := testClient(t)
+
+	tmpname := newKey("testCloseStream")
+	store := NewHashCookieStore(cl, tmpname, StreamInvalidation)
+	waitState(t, store.State, StateConnected)
+
+	done := make(chan error)
+	go func() { done <- store.Close() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not interrupt the blocking read")
+	}
+}
+
+func TestHashTagged(t *testing.T) {
+	for _, tt := range []struct{ prefix, want string }{
+		{"jar", "{jar}"},
+		{"{jar}", "{jar}"},
+		{"app:{jar}", "app:{jar}"},
+		{"{}jar", "{{}jar}"},
+		{"jar}", "{jar}}"},
+	} {
+		if got := HashTagged(tt.prefix); got != tt.want {
+			t.Errorf("HashTagged(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+// universalClient is a redis.UniversalClient other than *redis.Client, like
+// a ClusterClient.
+type universalClient struct {
+	*redis.Client
+}
+
+func TestUniversalConformance(t *testing.T) {
+	cl, newKey := testClient(t)
+	uc := universalClient{cl}
+
+	t.Run("Blob", func(t *testing.T) {
+		storagetest.Run(t, func(t *testing.T) (a, b cookiejar2.EntryStorage) {
+			tmpname := newKey("testUniversalStore")
+			a = NewRedisCookieStore(uc, tmpname, HashTag)
+			b = NewRedisCookieStore(uc, tmpname, HashTag)
+			waitConnected(t, a, b)
+			return a, b
+		})
+	})
+
+	t.Run("HashStream", func(t *testing.T) {
+		storagetest.Run(t, func(t *testing.T) (a, b cookiejar2.EntryStorage) {
+			tmpname := newKey("testUniversalHash")
+			a = NewHashCookieStore(uc, tmpname, HashTag, StreamInvalidation)
+			b = NewHashCookieStore(uc, tmpname, HashTag, StreamInvalidation)
+			waitConnected(t, a, b)
+			return a, b
+		})
+	})
+
+	// All keys of a store share the hash tag.
+	tmpname := newKey("testUniversalKeys")
+	store := NewHashCookieStore(uc, tmpname, HashTag)
+	defer store.Close()
+	if err := store.Save(storagetest.Entries()); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := cl.Keys("*" + tmpname + "*").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) == 0 {
+		t.Fatal("no keys written")
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "{"+tmpname+"}:") {
+			t.Errorf("key %q lacks the hash tag", key)
+		}
+	}
+}
+
+func TestKeyTTL(t *testing.T) {
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := func(persistent bool, expires time.Time) cookiejar2.CookieEntries {
+		return cookiejar2.CookieEntries{
+			"foobar.com": {"foobar.com;/;a": {Name: "a", Domain: "foobar.com", Path: "/", Persistent: persistent, Expires: expires}},
+		}
+	}
+
+	opts := newOptions([]Option{WithKeyExpiry(time.Hour, 10*time.Minute)})
+	for _, tt := range []struct {
+		name    string
+		opts    *options
+		entries cookiejar2.CookieEntries
+		want    time.Duration
+	}{
+		{"unmanaged", newOptions(nil), entries(true, now.Add(time.Hour)), 0},
+		{"persistent", opts, entries(true, now.Add(24*time.Hour)), 25 * time.Hour},
+		{"session", opts, entries(false, time.Time{}), 10 * time.Minute},
+		{"expired", opts, entries(true, now.Add(-time.Hour)), 10 * time.Minute},
+		{"empty", opts, nil, 10 * time.Minute},
+		{"no idle", newOptions([]Option{WithKeyExpiry(time.Hour, 0)}), entries(false, time.Time{}), -time.Millisecond},
+	} {
+		if got := tt.opts.keyTTL(tt.entries, now); got != int64(tt.want/time.Millisecond) {
+			t.Errorf("%s: keyTTL = %dms, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestKeyExpiry(t *testing.T) {
+	cl, newKey := testClient(t)
+
+	persistent := cookiejar2.CookieEntries{
+		"foobar.com": {"foobar.com;/;a": {Name: "a", Domain: "foobar.com", Path: "/", Persistent: true, Expires: time.Now().Add(2 * time.Hour)}},
+	}
+	session := cookiejar2.CookieEntries{
+		"foobar.com": {"foobar.com;/;b": {Name: "b", Domain: "foobar.com", Path: "/"}},
+	}
+
+	// ttl returns the TTL of key, rounded to minutes.
+	ttl := func(key string) time.Duration {
+		d, err := cl.PTTL(key).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Round(time.Minute)
+	}
+
+	for _, hash := range []bool{false, true} {
+		tmpname := newKey("testKeyExpiry")
+		opt := WithKeyExpiry(time.Hour, 10*time.Minute)
+		var store cookiejar2.EntryStorage
+		keys := []string{StoreName(tmpname), MetaName(tmpname), StreamName(tmpname)}
+		if hash {
+			store = NewHashCookieStore(cl, tmpname, opt)
+			keys = append(keys, DomainName(tmpname, "foobar.com"))
+		} else {
+			store = NewRedisCookieStore(cl, tmpname, opt)
+		}
+
+		start := time.Now()
+		if err := store.Save(persistent); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			if got := ttl(key); got != 3*time.Hour {
+				t.Errorf("hash %v: TTL of %s = %v, want 3h", hash, key, got)
+			}
+		}
+		// The meta hash may expire, so revisions do not start from 1.
+		if rev, _ := cl.HGet(MetaName(tmpname), "rev").Int64(); rev <= unixMillis(start) {
+			t.Errorf("hash %v: first revision %d, want one after %d", hash, rev, unixMillis(start))
+		}
+
+		// The next save refreshes the TTL from the new entries.
+		if err := store.Save(session); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			if got := ttl(key); got != 10*time.Minute {
+				t.Errorf("hash %v: TTL of %s = %v, want 10m", hash, key, got)
+			}
+		}
+
+		// Saves without changes refresh the TTL too.
+		for _, key := range keys {
+			cl.PExpire(key, time.Minute)
+		}
+		if err := store.Save(session); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			if got := ttl(key); got != 10*time.Minute {
+				t.Errorf("hash %v: TTL of %s after an unchanged save = %v, want 10m", hash, key, got)
+			}
+		}
+
+		// Saves without the option leave the expiry alone.
+		if !hash {
+			if err := SetCookies(cl, tmpname, persistent, "test"); err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range keys {
+				if got := ttl(key); got != 10*time.Minute {
+					t.Errorf("TTL of %s after SetCookies = %v, want 10m", key, got)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package rediscookiestore
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	// streamBlock is how long a single XREAD waits for new invalidations.
+	streamBlock = 5 * time.Second
+
+	// streamPoll is how often the stream is read when blocking reads are
+	// not possible.
+	streamPoll = time.Second
+)
+
+func StreamName(key string) string {
+	return fmt.Sprintf("%s:stream", key)
+}
+
+// listenStream calls handle with every invalidation added to the stream of
+// key, in order, until the listener is closed. After a read error, it
+// resumes from the last entry it has seen with exponential backoff, and then
+// calls resync, which reloads if invalidations were trimmed from the stream
+// in the meantime. It also resyncs after its first read, as the store may have
+// been saved between its last load and then. A failed resync is retried.
+//
+// The blocking reads use a dedicated connection, so that they do not hold
+// one of the connections of the pool shared with the saves. That requires a
+// *redis.Client; with other clients, such as a ClusterClient, the stream is
+// polled every streamPoll instead.
+func (l *listener) listenStream(shared redis.UniversalClient, key string, handle func(payload string), resync func() error) {
+	defer close(l.doneCh)
+
+	client := shared
+	poll := true
+	if c, ok := shared.(*redis.Client); ok {
+		opts := *c.Options()
+		opts.PoolSize = 1
+		opts.ReadTimeout = streamBlock + 5*time.Second
+		dedicated := redis.NewClient(&opts)
+		if !l.setCloser(dedicated.Close) {
+			return
+		}
+		defer dedicated.Close()
+
+		client = dedicated
+		poll = false
+	}
+
+	stream := StreamName(key)
+
+	lastID := ""
+	// The invalidations added before the first read are missed, like those
+	// added during a failure.
+	failed := true
+	backoff := minBackoff
+	for !l.closed() {
+		// After a failure, catch up without waiting for new entries, so that
+		// the resync is not delayed.
+		block := streamBlock
+		if failed || poll {
+			block = -1
+		}
+
+		var (
+			streams []redis.XStream
+			err     error
+		)
+		if lastID == "" {
+			lastID, err = latestID(client, stream)
+		} else {
+			streams, err = client.XRead(&redis.XReadArgs{
+				Streams: []string{stream, lastID},
+				Count:   100,
+				Block:   block,
+			}).Result()
+		}
+		if err != nil && err != redis.Nil {
+			if l.closed() {
+				return
+			}
+			log.Printf("Failed to read invalidation stream %s: %v\n", stream, err)
+			l.failed(err)
+			failed = true
+			if !l.sleep(backoff) {
+				return
+			}
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		for _, s := range streams {
+			for _, msg := range s.Messages {
+				lastID = msg.ID
+				if payload, ok := msg.Values["msg"].(string); ok {
+					handle(payload)
+				}
+			}
+		}
+
+		if failed {
+			if err := resync(); err != nil {
+				log.Printf("Failed to resync %s: %v\n", key, err)
+				l.failed(err)
+				if !l.sleep(backoff) {
+					return
+				}
+				backoff = nextBackoff(backoff)
+				continue
+			}
+			failed = false
+		}
+		backoff = minBackoff
+		l.connected()
+
+		if poll && len(streams) == 0 && !l.sleep(streamPoll) {
+			return
+		}
+	}
+}
+
+// latestID returns the id to start reading stream from: that of its latest
+// entry, or one before every entry if it does not exist yet.
+func latestID(client redis.UniversalClient, stream string) (string, error) {
+	msgs, err := client.XRevRangeN(stream, "+", "-", 1).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(msgs) == 0 {
+		return "0-0", nil
+	}
+	return msgs[0].ID, nil
+}
+
+// storeRev returns the current revision of the store with the given key.
+func storeRev(client redis.UniversalClient, key string) (int64, error) {
+	rev, err := client.HGet(MetaName(key), "rev").Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return rev, err
+}
@@ -0,0 +1,79 @@
+package rediscookiestore
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// ParseURL parses a redis://[:password@]host:port[,host:port...]/db URL,
+// with an optional master query parameter naming the Sentinel master, into
+// options for redis.NewUniversalClient. Several hosts select a Redis
+// Cluster, or the sentinels if master is set.
+func ParseURL(s string) (*redis.UniversalOptions, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		// The error of url.Parse includes the URL, and with it the
+		// password.
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("invalid scheme %q", u.Scheme)
+	}
+
+	opts := &redis.UniversalOptions{
+		MasterName: u.Query().Get("master"),
+	}
+	if u.User != nil {
+		opts.Password, _ = u.User.Password()
+	}
+
+	for _, addr := range strings.Split(u.Host, ",") {
+		if addr == "" {
+			return nil, errors.New("empty host")
+		}
+		if !strings.Contains(addr, ":") {
+			addr += ":6379"
+		}
+		opts.Addrs = append(opts.Addrs, addr)
+	}
+
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if opts.DB, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database %q", db)
+		}
+	}
+
+	return opts, nil
+}
+
+// RedactURL returns the Redis URL s with its password replaced by "xxxxx",
+// for use in messages.
+func RedactURL(s string) string {
+	i := strings.Index(s, "://")
+	if i == -1 {
+		return s
+	}
+	rest := s[i+3:]
+	end := strings.IndexAny(rest, "/?#")
+	if end == -1 {
+		end = len(rest)
+	}
+	at := strings.LastIndex(rest[:end], "@")
+	if at == -1 {
+		return s
+	}
+
+	user := rest[:at]
+	if colon := strings.Index(user, ":"); colon >= 0 {
+		user = user[:colon+1] + "xxxxx"
+	}
+	return s[:i+3] + user + rest[at:]
+}